@@ -0,0 +1,493 @@
+package caddy
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ruvido/goSpotifyPodcastAnalytics/data"
+)
+
+// keyTag is how the first request of a stream or listener was classified.
+type keyTag struct {
+	Category string `json:"c"`
+	App      string `json:"a,omitempty"`
+	Group    string `json:"g,omitempty"` // Value of the --by dimension
+	Show     string `json:"s,omitempty"`
+}
+
+// dayState keeps the distinct stream and listener keys seen on one day,
+// each mapped to the classification of its first request, and the IAB
+// downloads attributed to the day per category. With several shows, the
+// listeners of each show are kept apart as well, since one person can
+// listen to more than one. The listeners are also sketched, overall, per
+// episode and per breakdown, for estimating distinct listeners over any
+// range of days (see Reach and totals).
+//
+// Keys are only needed while requests for the day can still arrive: once
+// the day is closed (see compact), they are replaced by what they count.
+type dayState struct {
+	Streams       map[string]keyTag `json:"streams,omitempty"`
+	Listeners     map[string]keyTag `json:"listeners,omitempty"`
+	ShowListeners map[string]string `json:"showListeners,omitempty"` // show+listener key to show
+	Downloads     map[string]int    `json:"downloads,omitempty"`
+
+	// Counts of the keys dropped when the day was closed
+	Closed *TimeSeries `json:"closed,omitempty"`
+
+	Sketch          *sketch            `json:"sketch,omitempty"`
+	EpisodeSketches map[string]*sketch `json:"episodeSketches,omitempty"`
+	Sketches        map[string]*sketch `json:"sketches,omitempty"` // Per breakdown (see dimensions)
+
+	// Web page views and their distinct visitors
+	Views    int                 `json:"views,omitempty"`
+	Visitors map[string]struct{} `json:"visitors,omitempty"`
+}
+
+// Aggregator accumulates per-day streams and listeners. It can be fed in
+// several passes and serialized in between, so that a later run only has
+// to add the log lines it has not seen yet.
+type Aggregator struct {
+	Days   map[string]*dayState `json:"days"`
+	Hours  map[string]*dayState `json:"hours,omitempty"`  // Only with Options.Hourly, without IAB downloads or sketches
+	Titles map[string]string    `json:"titles,omitempty"` // Episode key to feed title, for Reach
+
+	// IAB download windows still open, and when they were last swept
+	Windows   map[string]*downloadWindow `json:"windows,omitempty"`
+	LastSweep float64                    `json:"lastSweep,omitempty"`
+
+	iab    *IABOptions
+	by     string
+	hourly bool
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{Days: make(map[string]*dayState), Titles: make(map[string]string)}
+}
+
+// EnableIAB makes the aggregator count IAB downloads next to the naive
+// streams.
+func (a *Aggregator) EnableIAB(opts *IABOptions) {
+	a.iab = opts
+	if a.Windows == nil {
+		a.Windows = make(map[string]*downloadWindow)
+	}
+}
+
+// SetBreakdown makes the aggregator break counts down by a dimension of
+// the records (see Breakdowns).
+func (a *Aggregator) SetBreakdown(by string) {
+	a.by = by
+}
+
+// configure applies the counting modes of opts.
+func (a *Aggregator) configure(opts Options) {
+	if opts.IAB != nil {
+		a.EnableIAB(opts.IAB)
+	}
+	a.SetBreakdown(opts.By)
+	a.hourly = opts.Hourly
+}
+
+func (a *Aggregator) day(date string) *dayState {
+	return periodState(a.Days, date)
+}
+
+// hour returns the state of one hour ("2006-01-02 15"), kept with
+// Options.Hourly.
+func (a *Aggregator) hour(hour string) *dayState {
+	if a.Hours == nil {
+		a.Hours = make(map[string]*dayState)
+	}
+	return periodState(a.Hours, hour)
+}
+
+// periodState returns the state of a day or hour, making room for it and
+// for whatever an older cache did not persist.
+func periodState(periods map[string]*dayState, key string) *dayState {
+	day, ok := periods[key]
+	if !ok {
+		day = &dayState{}
+		periods[key] = day
+	}
+	if day.Streams == nil {
+		day.Streams = make(map[string]keyTag)
+	}
+	if day.Listeners == nil {
+		day.Listeners = make(map[string]keyTag)
+	}
+	if day.Downloads == nil {
+		day.Downloads = make(map[string]int)
+	}
+	if day.ShowListeners == nil {
+		day.ShowListeners = make(map[string]string)
+	}
+	if day.Visitors == nil {
+		day.Visitors = make(map[string]struct{})
+	}
+	if day.Sketch == nil {
+		day.Sketch = newSketch()
+	}
+	if day.EpisodeSketches == nil {
+		day.EpisodeSketches = make(map[string]*sketch)
+	}
+	if day.Sketches == nil {
+		day.Sketches = make(map[string]*sketch)
+	}
+	return day
+}
+
+// Add counts a single log record: a stream for audio, a view for a page.
+// With hourly counts, the record is counted in its hour as well.
+func (a *Aggregator) Add(entry LogData) {
+	if !pageView(entry) && !countable(entry) {
+		return
+	}
+	date := entry.Timestamp[:10] // Extract the date (YYYY-MM-DD)
+	category := entry.Category
+	if category == "" {
+		category = classifyUserAgent(entry.UserAgent)
+	}
+
+	a.record(a.day(date), entry, category, true)
+	if a.hourly {
+		a.record(a.hour(entry.Timestamp[:13]), entry, category, false)
+	}
+	if a.iab != nil && countable(entry) {
+		a.addIAB(entry, date, category)
+	}
+}
+
+// record counts a page view or stream in the state of its day or hour;
+// only days sketch their listeners.
+func (a *Aggregator) record(day *dayState, entry LogData, category string, sketched bool) {
+	listenerKey := entry.RealIP + entry.UserAgent
+	if pageView(entry) {
+		day.Views++
+		day.Visitors[listenerKey] = struct{}{}
+		if sketched {
+			day.dimensionSketch(visitorDimension).add(sketchID(entry))
+		}
+		return
+	}
+
+	tag := keyTag{Category: category, App: entry.App, Show: entry.Show}
+	if a.by != "" {
+		tag.Group = breakdownValue(entry, a.by)
+	}
+	epKey := episodeKey(entry) + listenerKey
+	if _, seen := day.Streams[epKey]; !seen {
+		day.Streams[epKey] = tag
+	}
+	if _, seen := day.Listeners[listenerKey]; !seen {
+		day.Listeners[listenerKey] = tag
+	}
+	if entry.Show != "" {
+		day.ShowListeners[entry.Show+"\x00"+listenerKey] = entry.Show
+	}
+	if !sketched {
+		return
+	}
+	id := sketchID(entry)
+	day.Sketch.add(id)
+	day.episodeSketch(reachKey(entry)).add(id)
+	for _, dimension := range dimensions(tag) {
+		day.dimensionSketch(dimension).add(id)
+	}
+	if entry.Episode != nil && entry.Episode.Title != "" {
+		a.titles()[reachKey(entry)] = entry.Episode.Title
+	}
+}
+
+// episodeSketch returns the listener sketch of an episode, making room for
+// it.
+func (day *dayState) episodeSketch(key string) *sketch {
+	s, ok := day.EpisodeSketches[key]
+	if !ok {
+		s = newSketch()
+		day.EpisodeSketches[key] = s
+	}
+	return s
+}
+
+// dimensionSketch returns the listener sketch of a breakdown, making room
+// for it.
+func (day *dayState) dimensionSketch(dimension string) *sketch {
+	s, ok := day.Sketches[dimension]
+	if !ok {
+		s = newSketch()
+		day.Sketches[dimension] = s
+	}
+	return s
+}
+
+// visitorDimension names the sketch of the page visitors.
+const visitorDimension = "v:"
+
+// dimensions names the breakdowns a listener with tag is counted in, as
+// kind and value: "c:web", "a:Overcast", "g:IT", "s:show".
+func dimensions(tag keyTag) []string {
+	names := []string{"c:" + tag.Category}
+	if tag.App != "" {
+		names = append(names, "a:"+tag.App)
+	}
+	if tag.Group != "" {
+		names = append(names, "g:"+tag.Group)
+	}
+	if tag.Show != "" {
+		names = append(names, "s:"+tag.Show)
+	}
+	return names
+}
+
+// titles returns the episode titles, making room for them in aggregators
+// loaded from a cache without any.
+func (a *Aggregator) titles() map[string]string {
+	if a.Titles == nil {
+		a.Titles = make(map[string]string)
+	}
+	return a.Titles
+}
+
+// countable reports whether a request counts as a stream: it served audio
+// bytes in answer to a GET with a 2xx status (206 included). HEAD
+// requests, redirects and errors do not count; records that do not log
+// the method or status are given the benefit of the doubt.
+func countable(entry LogData) bool {
+	if entry.Kind != kindAudio || entry.Size <= 0 {
+		return false
+	}
+	if entry.Method != "" && entry.Method != "GET" {
+		return false
+	}
+	return entry.Status == 0 || (entry.Status >= 200 && entry.Status <= 299)
+}
+
+// Merge adds the keys counted by other, so that a request seen in two logs
+// still counts once. IAB downloads and page views are summed: download
+// windows are not combined across logs. So are the counts of closed days,
+// which have no keys left to compare.
+func (a *Aggregator) Merge(other *Aggregator) {
+	for date, otherDay := range other.Days {
+		a.day(date).merge(otherDay)
+	}
+	for hour, otherHour := range other.Hours {
+		a.hour(hour).merge(otherHour)
+	}
+	for key, title := range other.Titles {
+		a.titles()[key] = title
+	}
+}
+
+func (day *dayState) merge(otherDay *dayState) {
+	for category, n := range otherDay.Downloads {
+		day.Downloads[category] += n
+	}
+	for key, tag := range otherDay.Streams {
+		if _, seen := day.Streams[key]; !seen {
+			day.Streams[key] = tag
+		}
+	}
+	for key, tag := range otherDay.Listeners {
+		if _, seen := day.Listeners[key]; !seen {
+			day.Listeners[key] = tag
+		}
+	}
+	for key, show := range otherDay.ShowListeners {
+		day.ShowListeners[key] = show
+	}
+	if otherDay.Closed != nil {
+		var closed TimeSeries
+		if day.Closed != nil {
+			closed = *day.Closed
+		}
+		closed = addCounts(closed, *otherDay.Closed, true)
+		day.Closed = &closed
+	}
+	day.Views += otherDay.Views
+	for key := range otherDay.Visitors {
+		day.Visitors[key] = struct{}{}
+	}
+	day.Sketch.merge(otherDay.Sketch)
+	for key, s := range otherDay.EpisodeSketches {
+		day.episodeSketch(key).merge(s)
+	}
+	for dimension, s := range otherDay.Sketches {
+		day.dimensionSketch(dimension).merge(s)
+	}
+}
+
+// openDays is how many of the latest days keep their keys when the
+// aggregates are compacted: requests logged just before midnight can
+// still show up after it.
+const openDays = 2
+
+// compact closes the days (and hours) before the latest openDays days
+// with keys, replacing their keys with their counts, so that persisted
+// aggregates grow with the days rather than with the listeners. A request
+// arriving for a closed day is still counted, but cannot be told apart
+// from those counted before it closed.
+func (a *Aggregator) compact() {
+	latest := ""
+	for date, day := range a.Days {
+		if len(day.Streams)+len(day.Visitors) > 0 && date > latest {
+			latest = date
+		}
+	}
+	day, err := time.Parse("2006-01-02", latest)
+	if err != nil {
+		return
+	}
+	cutoff := day.AddDate(0, 0, 1-openDays).Format("2006-01-02")
+	for date, day := range a.Days {
+		if date < cutoff {
+			day.close()
+		}
+	}
+	for hour, state := range a.Hours {
+		if hour[:10] < cutoff {
+			state.close()
+		}
+	}
+}
+
+// close moves the counts of the keys of a day into Closed and drops the
+// keys.
+func (day *dayState) close() {
+	if len(day.Streams)+len(day.Listeners)+len(day.ShowListeners)+len(day.Visitors) == 0 {
+		return
+	}
+	closed := day.counts()
+	day.Closed = &closed
+	day.Streams = make(map[string]keyTag)
+	day.Listeners = make(map[string]keyTag)
+	day.ShowListeners = make(map[string]string)
+	day.Visitors = make(map[string]struct{})
+}
+
+// counts returns the streams, listeners and visitors of a day: those
+// counted when it was closed, and those of the keys seen since.
+func (day *dayState) counts() TimeSeries {
+	var ts TimeSeries
+	if day.Closed != nil {
+		ts = addCounts(ts, *day.Closed, true)
+	}
+	for _, tag := range day.Streams {
+		ts = incrementTag(ts, tag, true)
+	}
+	for _, tag := range day.Listeners {
+		ts = incrementTag(ts, tag, false)
+	}
+	for _, show := range day.ShowListeners {
+		ts = incrementShow(ts, show, false)
+	}
+	ts.Webpage.Visitors += len(day.Visitors)
+	return ts
+}
+
+// timeSeries returns every count of a day.
+func (day *dayState) timeSeries() TimeSeries {
+	ts := day.counts()
+	for category, n := range day.Downloads {
+		ts = addDownloads(ts, category, n)
+	}
+	ts.Webpage.Views = day.Views
+	return ts
+}
+
+// Result turns the accumulated keys into per-day counts, in date order,
+// with zeros for the days without traffic between the first and the last.
+func (a *Aggregator) Result() Result {
+	dates := make([]string, 0, len(a.Days))
+	for date := range a.Days {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	var result Result
+	if len(dates) == 0 {
+		return result
+	}
+	for _, date := range data.Days(dates[0], dates[len(dates)-1]) {
+		ts := TimeSeries{Date: date}
+		if day, ok := a.Days[date]; ok {
+			ts = day.timeSeries()
+			ts.Date = date
+		}
+		result.TimeSeries = append(result.TimeSeries, ts)
+	}
+	return result
+}
+
+// addCounts adds the streams and downloads of other to ts, in every
+// breakdown, and with listeners its listeners and visitors too.
+func addCounts(ts TimeSeries, other TimeSeries, listeners bool) TimeSeries {
+	add := func(into *Counts, from Counts) {
+		into.Streams += from.Streams
+		into.Downloads += from.Downloads
+		if listeners {
+			into.Listeners += from.Listeners
+		}
+	}
+	addMap := func(into map[string]Counts, from map[string]Counts) map[string]Counts {
+		if len(from) > 0 && into == nil {
+			into = make(map[string]Counts)
+		}
+		for name, counts := range from {
+			sum := into[name]
+			add(&sum, counts)
+			into[name] = sum
+		}
+		return into
+	}
+	add(&ts.All, other.All)
+	add(&ts.Web, other.Web)
+	add(&ts.Spotify, other.Spotify)
+	add(&ts.Other, other.Other)
+	ts.Categories = addMap(ts.Categories, other.Categories)
+	ts.Apps = addMap(ts.Apps, other.Apps)
+	ts.Breakdown = addMap(ts.Breakdown, other.Breakdown)
+	ts.Shows = addMap(ts.Shows, other.Shows)
+	ts.Webpage.Views += other.Webpage.Views
+	if listeners {
+		ts.Webpage.Visitors += other.Webpage.Visitors
+	}
+	return ts
+}
+
+// incrementTag counts a stream or listener in every breakdown its tag
+// belongs to.
+func incrementTag(ts TimeSeries, tag keyTag, isStream bool) TimeSeries {
+	ts = incrementCount(ts, tag.Category, isStream)
+	if tag.App != "" {
+		ts = incrementApp(ts, tag.App, isStream)
+	}
+	if tag.Group != "" {
+		ts = incrementGroup(ts, tag.Group, isStream)
+	}
+	// Show listeners are counted from dayState.ShowListeners
+	if tag.Show != "" && isStream {
+		ts = incrementShow(ts, tag.Show, isStream)
+	}
+	return ts
+}
+
+// FilterResult returns one entry per day from startDate to endDate
+// (inclusive), in order: the counted days in that range, and zeros for
+// the days without traffic.
+func FilterResult(result Result, startDate, endDate string) Result {
+	byDate := make(map[string]TimeSeries, len(result.TimeSeries))
+	for _, ts := range result.TimeSeries {
+		byDate[ts.Date] = ts
+	}
+
+	days := data.Days(startDate, endDate)
+	filtered := Result{TimeSeries: make([]TimeSeries, 0, len(days))}
+	for _, date := range days {
+		ts, ok := byDate[date]
+		if !ok {
+			ts = TimeSeries{Date: date}
+		}
+		filtered.TimeSeries = append(filtered.TimeSeries, ts)
+	}
+	return filtered
+}
@@ -0,0 +1,57 @@
+package caddy
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCompact closes all but the latest days of a month: the persisted
+// aggregates lose the keys of the closed days, not their counts.
+func TestCompact(t *testing.T) {
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.Local)
+	data, opts := anonymizedLog(t, start, 10, 30)
+	opts.Hourly = true
+	agg := Aggregate(data, opts)
+	want := agg.Result()
+	wantSummary := agg.Summary("2024-06-01", "2024-06-30")
+
+	agg.compact()
+	for date, day := range agg.Days {
+		open := date >= "2024-06-29"
+		if got := len(day.Listeners) > 0; got != open {
+			t.Errorf("%s: keys kept %v, want %v", date, got, open)
+		}
+	}
+
+	content, err := json.Marshal(agg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range data[:len(data)-20] {
+		if strings.Contains(string(content), entry.RealIP) {
+			t.Fatalf("key of %s persisted after its day closed", entry.Timestamp)
+		}
+	}
+	loaded := NewAggregator()
+	if err := json.Unmarshal(content, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Result(); !reflect.DeepEqual(got, want) {
+		t.Errorf("compacted result\n%+v\nwant\n%+v", got, want)
+	}
+	if got := loaded.Summary("2024-06-01", "2024-06-30"); !reflect.DeepEqual(got.Totals, wantSummary.Totals) {
+		t.Errorf("compacted totals %+v, want %+v", got.Totals, wantSummary.Totals)
+	}
+
+	// A request for a closed day adds to its counts
+	late := data[0]
+	late.URI = "/e9.mp3"
+	loaded.configure(opts)
+	loaded.Add(late)
+	if got := loaded.Result().TimeSeries[0].All.Streams; got != want.TimeSeries[0].All.Streams+1 {
+		t.Errorf("%d streams after a late request, want %d", got, want.TimeSeries[0].All.Streams+1)
+	}
+}
@@ -0,0 +1,194 @@
+package caddy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// anonymizeKeySize is the length in bytes of the secret the daily salts
+// are derived from.
+const anonymizeKeySize = 32
+
+// Anonymizer replaces client addresses with keyed hashes as soon as a
+// record is read, so that no IP address is ever persisted or output.
+//
+// The hash key (the salt) changes every day: the same client gets
+// unrelated pseudonyms on different days, and those are all that caches
+// and reports ever hold. Telling listeners apart over weeks and months
+// needs a returning client to be recognized, so records also carry a
+// listener pseudonym that does not rotate, kept in memory only and hashed
+// into the listener sketches (see Reach), which keep a few bits of the
+// hash of every key, never the key itself.
+type Anonymizer struct {
+	key      []byte
+	truncate bool
+
+	mu    sync.RWMutex // Guards salts: logs are parsed concurrently
+	salts map[string][]byte
+}
+
+// LoadAnonymizer reads the secret the daily salts are derived from,
+// creating keyPath with a random one on first use. Deleting the file makes
+// every pseudonym issued so far unlinkable to an address. With truncate,
+// addresses are cut to their /24 (IPv4) or /48 (IPv6) network before
+// hashing.
+func LoadAnonymizer(keyPath string, truncate bool) (*Anonymizer, error) {
+	content, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		content, err = createAnonymizeKey(keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read anonymization key: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) < anonymizeKeySize {
+		return nil, fmt.Errorf("invalid anonymization key %s: expected %d hex encoded bytes", keyPath, anonymizeKeySize)
+	}
+	return &Anonymizer{key: key, truncate: truncate, salts: make(map[string][]byte)}, nil
+}
+
+func createAnonymizeKey(keyPath string) ([]byte, error) {
+	key := make([]byte, anonymizeKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0o700); err != nil {
+		return nil, err
+	}
+	content := []byte(hex.EncodeToString(key) + "\n")
+	if err := os.WriteFile(keyPath, content, 0o600); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Digest identifies the key and settings, so caches holding pseudonyms
+// from another key are not resumed. It reveals nothing about the key.
+func (a *Anonymizer) Digest() string {
+	mac := hmac.New(sha256.New, a.key)
+	fmt.Fprintf(mac, "digest:%t", a.truncate)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// salt is the hash key of one day (YYYY-MM-DD), or of the listener
+// pseudonyms ("listener").
+func (a *Anonymizer) salt(date string) []byte {
+	a.mu.RLock()
+	salt, ok := a.salts[date]
+	a.mu.RUnlock()
+	if ok {
+		return salt
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte("salt:" + date))
+	salt = mac.Sum(nil)
+	a.mu.Lock()
+	a.salts[date] = salt
+	a.mu.Unlock()
+	return salt
+}
+
+// truncateIP keeps the network part of an address: /24 for IPv4, /48 for
+// IPv6. Anything that is not an address is returned unchanged.
+func truncateIP(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// pseudonym hashes address with the salt of period.
+func (a *Anonymizer) pseudonym(period, address string) string {
+	mac := hmac.New(sha256.New, a.salt(period))
+	mac.Write([]byte(address))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// Anonymize replaces the address of a record with its pseudonym for the
+// day of the request, and sets its listener pseudonym, dropping the raw
+// addresses they were resolved from.
+func (a *Anonymizer) Anonymize(entry *LogData) {
+	entry.RemoteIP, entry.ForwardedFor, entry.XRealIP = "", "", ""
+	if entry.RealIP == "" {
+		return
+	}
+	address := a.address(entry.RealIP)
+	entry.RealIP = a.pseudonym(requestDate(*entry), address)
+	entry.listener = a.pseudonym("listener", address)
+}
+
+// address is what gets hashed of a client address.
+func (a *Anonymizer) address(client string) string {
+	if a.truncate {
+		return truncateIP(client)
+	}
+	return client
+}
+
+// requestDate is the day (YYYY-MM-DD) whose salt a record is hashed with.
+func requestDate(entry LogData) string {
+	if len(entry.Timestamp) > 10 {
+		return entry.Timestamp[:10]
+	}
+	return entry.Timestamp
+}
+
+// redact replaces the addresses in a raw log line, for keeping it on disk:
+// the connection address and every address of the forwarding headers of
+// entry, the record decoded from line, become the pseudonym for the day
+// of client, the address resolved from them. Read back, the line counts
+// the same within its day, but the client can no longer be located, nor
+// recognized on another day.
+func (a *Anonymizer) redact(line []byte, entry LogData, client string) []byte {
+	pseudonym := []byte(a.pseudonym(requestDate(entry), a.address(client)))
+
+	var addresses []string
+	add := func(hop string) {
+		hop = strings.TrimSpace(hop)
+		if hop == "" {
+			return
+		}
+		addresses = append(addresses, hop)
+		if ip := parseHop(hop); ip != nil {
+			addresses = append(addresses, ip.String())
+		}
+	}
+	add(entry.RemoteIP)
+	add(entry.XRealIP)
+	for _, hop := range strings.Split(entry.ForwardedFor, ",") {
+		add(hop)
+	}
+	// Longest first, so that no address is replaced inside a longer one
+	sort.Slice(addresses, func(i, j int) bool { return len(addresses[i]) > len(addresses[j]) })
+	for _, address := range addresses {
+		line = bytes.ReplaceAll(line, []byte(address), pseudonym)
+	}
+	return line
+}
+
+// sketchID identifies the listener behind a request in the listener
+// sketches: the client address and User-Agent, or with anonymization the
+// listener pseudonym in place of the address, which unlike the daily one
+// recognizes a returning listener.
+func sketchID(entry LogData) string {
+	if entry.listener != "" {
+		return entry.listener + entry.UserAgent
+	}
+	return entry.RealIP + entry.UserAgent
+}
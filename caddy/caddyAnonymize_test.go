@@ -0,0 +1,82 @@
+package caddy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// anonymizedLog admits a request from each of clients on each of days
+// days from start, with addresses anonymized as by default.
+func anonymizedLog(t *testing.T, start time.Time, clients, days int) ([]LogData, Options) {
+	t.Helper()
+	anonymizer, err := LoadAnonymizer(filepath.Join(t.TempDir(), "anonymize.key"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Anonymizer: anonymizer}
+
+	var data []LogData
+	for day := 0; day < days; day++ {
+		for client := 0; client < clients; client++ {
+			logged := start.AddDate(0, 0, day).Add(time.Duration(client) * time.Minute)
+			entry := LogData{
+				Time:      logged,
+				Timestamp: logged.Format("2006-01-02 15:04:05"),
+				RemoteIP:  fmt.Sprintf("81.2.69.%d", client+1),
+				Host:      "pod.example.com",
+				URI:       fmt.Sprintf("/e%d.mp3", day%3),
+				UserAgent: "Overcast/3.0",
+				Method:    "GET",
+				Status:    200,
+				Size:      1000,
+			}
+			if !opts.admit(&entry) {
+				t.Fatalf("request %+v not admitted", entry)
+			}
+			data = append(data, entry)
+		}
+	}
+	return data, opts
+}
+
+func TestAnonymizeListenerPseudonym(t *testing.T) {
+	start := time.Date(2024, 12, 30, 12, 0, 0, 0, time.Local)
+	data, _ := anonymizedLog(t, start, 1, 3)
+
+	for _, entry := range data {
+		if strings.Contains(entry.RealIP+entry.listener, "81.2.69") || entry.RemoteIP != "" {
+			t.Fatalf("raw address left in %+v", entry)
+		}
+	}
+	if data[0].RealIP == data[1].RealIP {
+		t.Error("same address pseudonym on two days, want a new one every day")
+	}
+	if data[0].listener == "" || data[0].listener != data[2].listener {
+		t.Errorf("listener pseudonyms %q and %q in 2024 and 2025, want the same", data[0].listener, data[2].listener)
+	}
+}
+
+func TestReachAnonymized(t *testing.T) {
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.Local)
+	data, opts := anonymizedLog(t, start, 10, 30)
+	agg := Aggregate(data, opts)
+
+	summary := agg.Summary("2024-06-01", "2024-06-30")
+	if got := summary.Totals.All.Listeners; got < 10-reachMargin(10) || got > 10+reachMargin(10) {
+		t.Errorf("%d listeners over the month, want 10", got)
+	}
+	if got := summary.Totals.All.Streams; got != 300 {
+		t.Errorf("%d streams over the month, want 300", got)
+	}
+	if got := summary.Reach.Listeners; got < 10-summary.Reach.Margin || got > 10+summary.Reach.Margin {
+		t.Errorf("reach of %d±%d listeners over the month, want 10", got, summary.Reach.Margin)
+	}
+	for _, episode := range summary.Reach.Episodes {
+		if episode.Listeners < 10-episode.Margin || episode.Listeners > 10+episode.Margin {
+			t.Errorf("reach of %d±%d listeners for %s, want 10", episode.Listeners, episode.Margin, episode.Episode)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// unknownApp labels requests that no entry of the app database matched.
+const unknownApp = "unknown"
+
+// maxCachedAgents is how many User-Agents an AppDatabase remembers the
+// entry of. Scanners send a new User-Agent with every request: once full,
+// the cache starts over rather than growing without bound.
+const maxCachedAgents = 1 << 14
+
+// appEntry is one record of the OPAWG podcast-user-agents database
+// (https://github.com/opawg/user-agents).
+type appEntry struct {
+	UserAgents []string `json:"user_agents"`
+	App        string   `json:"app"`
+	Device     string   `json:"device"`
+	OS         string   `json:"os"`
+	Bot        bool     `json:"bot"`
+
+	patterns []*regexp.Regexp
+}
+
+// AppDatabase identifies podcast apps, devices and operating systems from
+// User-Agent strings.
+type AppDatabase struct {
+	entries []appEntry
+
+	mu    sync.RWMutex // Guards cache: logs are parsed concurrently
+	cache map[string]*appEntry
+}
+
+// LoadAppDatabase reads a JSON file in the OPAWG user-agents format. The
+// first entry whose pattern matches a User-Agent wins. Patterns that Go
+// regular expressions cannot compile are skipped with a warning.
+func LoadAppDatabase(path string) (*AppDatabase, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read app database: %w", err)
+	}
+
+	var entries []appEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal app database: %w", err)
+	}
+
+	for i := range entries {
+		for _, expr := range entries[i].UserAgents {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				// Some upstream patterns use PCRE-only syntax (lookarounds):
+				// skip them rather than the whole database
+				fmt.Fprintf(os.Stderr, "Skipping app database pattern %q of %q: %v\n", expr, entries[i].App, err)
+				continue
+			}
+			entries[i].patterns = append(entries[i].patterns, pattern)
+		}
+	}
+
+	return &AppDatabase{
+		entries: entries,
+		cache:   make(map[string]*appEntry),
+	}, nil
+}
+
+// lookup returns the entry matching userAgent, or nil. Podcast traffic
+// comes from a handful of distinct agents, so results are memoized.
+func (db *AppDatabase) lookup(userAgent string) *appEntry {
+	db.mu.RLock()
+	entry, ok := db.cache[userAgent]
+	db.mu.RUnlock()
+	if ok {
+		return entry
+	}
+
+	var found *appEntry
+	for i := range db.entries {
+		for _, pattern := range db.entries[i].patterns {
+			if pattern.MatchString(userAgent) {
+				found = &db.entries[i]
+				break
+			}
+		}
+		if found != nil {
+			break
+		}
+	}
+	db.mu.Lock()
+	if len(db.cache) >= maxCachedAgents {
+		db.cache = make(map[string]*appEntry)
+	}
+	db.cache[userAgent] = found
+	db.mu.Unlock()
+	return found
+}
+
+// Identify fills in the App, Device and OS of a record.
+func (db *AppDatabase) Identify(entry *LogData) {
+	found := db.lookup(entry.UserAgent)
+	if found == nil {
+		entry.App = unknownApp
+		return
+	}
+	entry.App = found.App
+	entry.Device = strings.ToLower(found.Device)
+	entry.OS = strings.ToLower(found.OS)
+}
+
+// Bot names the app database entry identifying userAgent as a bot (its
+// "bot" flag), as "app: " and the entry name.
+func (db *AppDatabase) Bot(userAgent string) (string, bool) {
+	found := db.lookup(userAgent)
+	if found == nil || !found.Bot {
+		return "", false
+	}
+	return "app: " + found.App, true
+}
+
+// incrementApp counts a stream or listener in the per-app breakdown.
+func incrementApp(ts TimeSeries, app string, isStream bool) TimeSeries {
+	if ts.Apps == nil {
+		ts.Apps = make(map[string]Counts)
+	}
+	counts := ts.Apps[app]
+	if isStream {
+		counts.Streams++
+	} else {
+		counts.Listeners++
+	}
+	ts.Apps[app] = counts
+	return ts
+}
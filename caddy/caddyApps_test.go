@@ -0,0 +1,67 @@
+package caddy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadApps(t *testing.T) *AppDatabase {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "apps.json")
+	content := `[
+		{"user_agents": ["^Overcast/"], "app": "Overcast", "device": "Phone", "os": "iOS"},
+		{"user_agents": ["(?<=x)lookbehind", "^AppleCoreMedia/"], "app": "Apple Podcasts", "device": "Phone", "os": "iOS"},
+		{"user_agents": ["^Podcast Crawler"], "app": "Crawler", "bot": true}
+	]`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	apps, err := LoadAppDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apps
+}
+
+func TestAppDatabase(t *testing.T) {
+	apps := loadApps(t)
+	tests := []struct {
+		userAgent, app, device, os string
+	}{
+		{"Overcast/3.0 (+http://overcast.fm/; iOS podcast app)", "Overcast", "phone", "ios"},
+		// The pattern Go cannot compile is skipped, not the entry
+		{"AppleCoreMedia/1.0.0.21E236 (iPhone; U; CPU OS 17_4 like Mac OS X)", "Apple Podcasts", "phone", "ios"},
+		{"Mozilla/5.0", unknownApp, "", ""},
+	}
+	for _, test := range tests {
+		entry := LogData{UserAgent: test.userAgent}
+		apps.Identify(&entry)
+		if entry.App != test.app || entry.Device != test.device || entry.OS != test.os {
+			t.Errorf("%s: identified as %q %q %q, want %q %q %q", test.userAgent,
+				entry.App, entry.Device, entry.OS, test.app, test.device, test.os)
+		}
+	}
+
+	if bot, ok := apps.Bot("Podcast Crawler/2.0"); !ok || bot != "app: Crawler" {
+		t.Errorf("crawler flagged as %q (%v), want app: Crawler", bot, ok)
+	}
+	if bot, ok := apps.Bot("Overcast/3.0"); ok {
+		t.Errorf("Overcast flagged as bot %q, want no bot", bot)
+	}
+}
+
+func TestAppDatabaseCacheBound(t *testing.T) {
+	apps := loadApps(t)
+	for i := 0; i <= maxCachedAgents; i++ {
+		apps.lookup(fmt.Sprintf("Scanner/%d", i))
+	}
+	if len(apps.cache) > maxCachedAgents {
+		t.Errorf("%d User-Agents cached, want at most %d", len(apps.cache), maxCachedAgents)
+	}
+	entry := LogData{UserAgent: "Overcast/3.0"}
+	if apps.Identify(&entry); entry.App != "Overcast" {
+		t.Errorf("identified as %q after the cache started over, want Overcast", entry.App)
+	}
+}
@@ -0,0 +1,144 @@
+package caddy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// botRule is one line of the bot rule file.
+type botRule struct {
+	name    string
+	pattern *regexp.Regexp // Matched against the User-Agent
+	network *net.IPNet     // Matched against the client IP
+}
+
+// BotFilter recognizes crawlers, monitors and other non-listeners from a
+// local rule file, and keeps count of the requests each rule matched.
+type BotFilter struct {
+	rules   []botRule
+	mu      sync.Mutex // Guards Matched: logs are parsed concurrently
+	Matched map[string]int
+}
+
+// LoadBotFilter reads a rule file with one rule per line:
+//
+//	# comment
+//	ua (?i)googlebot
+//	ip 66.249.64.0/19
+//	ip 203.0.113.7
+//
+// "ua" rules are regular expressions matched against the User-Agent, "ip"
+// rules are addresses or CIDR ranges matched against the client IP.
+func LoadBotFilter(path string) (*BotFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bot rules: %w", err)
+	}
+	defer file.Close()
+
+	filter := &BotFilter{Matched: make(map[string]int)}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		rule := botRule{name: line}
+		switch kind {
+		case "ua":
+			rule.pattern, err = regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid pattern: %w", path, lineNumber, err)
+			}
+		case "ip":
+			if !strings.Contains(value, "/") {
+				if strings.Contains(value, ":") {
+					value += "/128"
+				} else {
+					value += "/32"
+				}
+			}
+			_, rule.network, err = net.ParseCIDR(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid address: %w", path, lineNumber, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown rule kind %q (expected ua or ip)", path, lineNumber, kind)
+		}
+		filter.rules = append(filter.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read bot rules: %w", err)
+	}
+
+	return filter, nil
+}
+
+// Match returns the first rule that identifies entry as a bot, and counts it.
+func (f *BotFilter) Match(entry LogData) (string, bool) {
+	rule, ok := f.match(entry)
+	if ok {
+		f.count(rule)
+	}
+	return rule, ok
+}
+
+// match is Match without counting, for looking at a request without it
+// showing up in the report.
+func (f *BotFilter) match(entry LogData) (string, bool) {
+	var ip net.IP
+	for _, rule := range f.rules {
+		if rule.pattern != nil && rule.pattern.MatchString(entry.UserAgent) {
+			return rule.name, true
+		}
+		if rule.network != nil {
+			if ip == nil {
+				ip = net.ParseIP(entry.RealIP)
+			}
+			if ip != nil && rule.network.Contains(ip) {
+				return rule.name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (f *BotFilter) count(rule string) {
+	f.mu.Lock()
+	f.Matched[rule]++
+	f.mu.Unlock()
+}
+
+// BotReport is how many requests one rule matched.
+type BotReport struct {
+	Rule     string `json:"rule"`
+	Requests int    `json:"requests"`
+}
+
+// Report lists the rules that matched anything, most frequent first.
+func (f *BotFilter) Report() []BotReport {
+	var report []BotReport
+	f.mu.Lock()
+	for rule, n := range f.Matched {
+		report = append(report, BotReport{Rule: rule, Requests: n})
+	}
+	f.mu.Unlock()
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Requests != report[j].Requests {
+			return report[i].Requests > report[j].Requests
+		}
+		return report[i].Rule < report[j].Rule
+	})
+	return report
+}
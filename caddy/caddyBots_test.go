@@ -0,0 +1,55 @@
+package caddy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBotFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bots.txt")
+	rules := "# Crawlers\nua (?i)googlebot\n\nip 66.249.64.0/19\nip 2001:db8::7\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := LoadBotFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		entry LogData
+		rule  string
+	}{
+		{"user agent", LogData{RealIP: "81.2.69.1", UserAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)"}, "ua (?i)googlebot"},
+		{"network", LogData{RealIP: "66.249.66.1", UserAgent: "curl/8.4.0"}, "ip 66.249.64.0/19"},
+		{"single address", LogData{RealIP: "2001:db8::7", UserAgent: "curl/8.4.0"}, "ip 2001:db8::7"},
+		{"listener", LogData{RealIP: "81.2.69.1", UserAgent: "Overcast/3.0 (+http://overcast.fm/; iOS podcast app)"}, ""},
+		{"no address", LogData{UserAgent: "Spotify/8.9.2 Android/33"}, ""},
+	}
+	for _, test := range tests {
+		rule, ok := filter.Match(test.entry)
+		if rule != test.rule || ok != (test.rule != "") {
+			t.Errorf("%s: Match = %q, %t, want %q", test.name, rule, ok, test.rule)
+		}
+	}
+
+	want := map[string]int{"ua (?i)googlebot": 1, "ip 66.249.64.0/19": 1, "ip 2001:db8::7": 1}
+	if !reflect.DeepEqual(filter.Matched, want) {
+		t.Errorf("Matched = %v, want %v", filter.Matched, want)
+	}
+}
+
+func TestLoadBotFilterErrors(t *testing.T) {
+	for _, rules := range []string{"ua (?i)google(bot\n", "ip 66.249.64.0/99\n", "agent curl\n"} {
+		path := filepath.Join(t.TempDir(), "bots.txt")
+		if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadBotFilter(path); err == nil {
+			t.Errorf("%q: loaded without an error", rules)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package caddy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ruvido/goSpotifyPodcastAnalytics/data"
+)
+
+// Buckets are the periods counts can be rolled up into with --bucket.
+var Buckets = []string{"hour", "day", "week", "month", "year"}
+
+// CheckBucket returns an error when bucket is not one of Buckets.
+func CheckBucket(bucket string) error {
+	for _, name := range Buckets {
+		if bucket == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot roll up by %q (supported: %s)", bucket, strings.Join(Buckets, ", "))
+}
+
+// bucketLabel names the bucket holding a day: the date itself, the ISO
+// week ("2024-W23", of the ISO year, so that the last days of December
+// can belong to week 1), the month ("2024-06") or the year.
+func bucketLabel(bucket, date string) string {
+	switch bucket {
+	case "week":
+		day, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return date
+		}
+		year, week := day.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case "month":
+		return date[:7]
+	case "year":
+		return date[:4]
+	}
+	return date
+}
+
+// Rollup counts the period from startDate to endDate (inclusive) per
+// bucket, in order, with zeros for the buckets without traffic. Within a
+// bucket, streams, IAB downloads and page views are summed over its days,
+// while listeners and visitors are distinct over the whole bucket, not
+// summed: a listener coming back every day of a month is one listener of
+// the month, with IP anonymization too, and so is one listening in the
+// last days of December and the first of January of one ISO week (see
+// totals). Days are those of the local time zone, and the first and last
+// buckets only cover the days of the period. Hours need an aggregator
+// kept with Options.Hourly; a stream heard over two hours counts in both.
+func (a *Aggregator) Rollup(bucket, startDate, endDate string) Result {
+	if bucket == "hour" {
+		return a.rollupHours(startDate, endDate)
+	}
+
+	var result Result
+	var label string
+	var days []*dayState
+	flush := func() {
+		if label == "" {
+			return
+		}
+		ts := totals(days)
+		ts.Date = label
+		result.TimeSeries = append(result.TimeSeries, ts)
+	}
+	for _, date := range data.Days(startDate, endDate) {
+		if next := bucketLabel(bucket, date); next != label {
+			flush()
+			label, days = next, nil
+		}
+		if day, ok := a.Days[date]; ok {
+			days = append(days, day)
+		}
+	}
+	flush()
+	return result
+}
+
+// rollupHours counts every hour of the period ("2024-06-01T14"). Hours are
+// those of the wall clock: the hour repeated when daylight saving time
+// ends counts as one.
+func (a *Aggregator) rollupHours(startDate, endDate string) Result {
+	var result Result
+	for _, date := range data.Days(startDate, endDate) {
+		for h := 0; h < 24; h++ {
+			hour := fmt.Sprintf("%s %02d", date, h)
+			var ts TimeSeries
+			if state, ok := a.Hours[hour]; ok {
+				ts = totals([]*dayState{state})
+			}
+			ts.Date = fmt.Sprintf("%sT%02d", date, h)
+			result.TimeSeries = append(result.TimeSeries, ts)
+		}
+	}
+	return result
+}
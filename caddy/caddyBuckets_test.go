@@ -0,0 +1,49 @@
+package caddy
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRollupAnonymized sees the same clients every day under the default
+// anonymization: each is one listener of its week, month and year, also
+// in a week spanning two years.
+func TestRollupAnonymized(t *testing.T) {
+	tests := []struct {
+		bucket     string
+		start, end string
+		buckets    []string
+		streams    int
+	}{
+		{"day", "2024-06-01", "2024-06-30", nil, 300},
+		{"week", "2024-06-01", "2024-06-30", []string{"2024-W22", "2024-W23", "2024-W24", "2024-W25", "2024-W26"}, 300},
+		{"month", "2024-06-01", "2024-06-30", []string{"2024-06"}, 300},
+		{"year", "2024-06-01", "2024-06-30", []string{"2024"}, 300},
+		{"week", "2024-12-30", "2025-01-05", []string{"2025-W01"}, 70},
+	}
+	for _, test := range tests {
+		start, _ := time.ParseInLocation("2006-01-02", test.start, time.Local)
+		end, _ := time.ParseInLocation("2006-01-02", test.end, time.Local)
+		days := int(end.Sub(start).Hours()/24+0.5) + 1
+		data, opts := anonymizedLog(t, start.Add(8*time.Hour), 10, days)
+		agg := Aggregate(data, opts)
+
+		result := agg.Rollup(test.bucket, test.start, test.end)
+		if test.buckets != nil && len(result.TimeSeries) != len(test.buckets) {
+			t.Fatalf("%s: got %d buckets, want %v", test.bucket, len(result.TimeSeries), test.buckets)
+		}
+		streams := 0
+		for i, ts := range result.TimeSeries {
+			if test.buckets != nil && ts.Date != test.buckets[i] {
+				t.Errorf("%s: bucket %d is %s, want %s", test.bucket, i, ts.Date, test.buckets[i])
+			}
+			if ts.All.Listeners < 10-reachMargin(10) || ts.All.Listeners > 10+reachMargin(10) {
+				t.Errorf("%s %s: %d listeners, want 10", test.bucket, ts.Date, ts.All.Listeners)
+			}
+			streams += ts.All.Streams
+		}
+		if streams != test.streams {
+			t.Errorf("%s from %s: %d streams in all, want %d", test.bucket, test.start, streams, test.streams)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package caddy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// fingerprintSize is how many leading bytes of a log file are hashed to
+// recognise it again after a restart, even if its inode has been reused.
+const fingerprintSize = 256
+
+// cacheVersion changes whenever the persisted aggregates change shape, so
+// that caches written by older versions are rebuilt instead of misread.
+const cacheVersion = 6
+
+// Checkpoint records how far a log file has been digested.
+type Checkpoint struct {
+	Path        string  `json:"path"`
+	Inode       uint64  `json:"inode"`
+	Fingerprint string  `json:"fingerprint"`
+	Offset      int64   `json:"offset"`
+	Line        int64   `json:"line"`
+	LastTs      float64 `json:"lastTs"`
+}
+
+// cacheState is what gets persisted between runs for one log file and filter.
+type cacheState struct {
+	Checkpoint Checkpoint  `json:"checkpoint"`
+	Filter     string      `json:"filter"`
+	Aggregator *Aggregator `json:"aggregator"`
+}
+
+// cacheSettings names the options that change how the lines of a log are
+// counted, with their values. The contents of the bot and user-agent rules
+// and of the app and GeoIP databases are left out, only whether each is
+// configured counts: they get routine updates, which apply from the next
+// line read, while the days already counted keep their counts instead of
+// being recounted from whatever logs are still on disk. Deleting the cache
+// recounts them. The feed is the exception: which episode each enclosure
+// path belongs to keys the streams, and keys that changed with it would
+// count the same stream twice, so a new or moved episode recounts the logs
+// on disk too.
+func cacheSettings(opts Options) map[string]string {
+	settings := map[string]string{
+		// Days and hours are those of the local time zone
+		"timezone": time.Local.String(),
+	}
+	if filter := opts.Filter.String(); filter != "" {
+		settings["filter"] = filter
+	}
+	if opts.IAB != nil {
+		settings["iab"] = fmt.Sprintf("%d kbps", opts.IAB.DefaultBitrate)
+	}
+	if opts.Bots != nil {
+		settings["bots"] = "on"
+	}
+	if opts.IncludeBots {
+		settings["include-bots"] = "on"
+	}
+	if opts.Apps != nil {
+		settings["apps"] = "on"
+	}
+	if opts.Classifier != nil {
+		settings["ua-rules"] = "on"
+	}
+	if opts.By != "" {
+		settings["by"] = opts.By
+	}
+	if opts.GeoIP != nil {
+		settings["geoip"] = "on"
+	}
+	if opts.Anonymizer != nil {
+		// Pseudonyms from another key would never match
+		settings["anonymization"] = opts.Anonymizer.Digest()
+	}
+	if opts.Feed != nil {
+		settings["feed"] = opts.Feed.Digest()
+	}
+	if opts.Shows != nil {
+		settings["shows"] = opts.Shows.String()
+	}
+	if opts.Proxies != nil {
+		settings["proxies"] = opts.Proxies.String()
+	}
+	if opts.Hourly {
+		settings["hourly"] = "on"
+	}
+	return settings
+}
+
+// cacheFilePath names the cache of one source. Every setting of
+// cacheSettings is part of the name, so a cache is never resumed with
+// different settings.
+func cacheFilePath(source Source, opts Options) (string, error) {
+	absPath := source.Path
+	if _, _, ok := source.Network(); !ok {
+		var err error
+		if absPath, err = filepath.Abs(source.Path); err != nil {
+			return "", fmt.Errorf("failed to resolve log path: %w", err)
+		}
+	}
+	key := fmt.Sprintf("v%d\x00%s\x00%s", cacheVersion, absPath, source.Format)
+	settings := cacheSettings(opts)
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key += "\x00" + name + "=" + settings[name]
+	}
+	sum := sha256.Sum256([]byte(key))
+	cacheDir := opts.CacheDir
+	return filepath.Join(cacheDir, "caddy-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+func loadCacheState(cachePath string) (*cacheState, error) {
+	content, err := os.ReadFile(cachePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+
+	var state cacheState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cache: %w", err)
+	}
+	if state.Aggregator == nil || state.Aggregator.Days == nil {
+		state.Aggregator = NewAggregator()
+	}
+	return &state, nil
+}
+
+func saveCacheState(cachePath string, state *cacheState) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	state.Aggregator.compact()
+	content, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache: %w", err)
+	}
+
+	// Write to a temporary file first so an interrupted run never leaves
+	// a half-written cache behind.
+	tmpPath := cachePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0o600); err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	return os.Rename(tmpPath, cachePath)
+}
+
+func fileFingerprint(file *os.File) (string, error) {
+	head := make([]byte, fingerprintSize)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	sum := sha256.Sum256(head[:n])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// resumeOffset decides where to continue reading: at the checkpoint offset
+// if the file is the same one we saw last time and has only grown, or from
+// the start if it has been rotated or truncated.
+func resumeOffset(cp Checkpoint, inode uint64, size int64, fingerprint string) (offset int64, restarted bool) {
+	if cp.Offset == 0 {
+		return 0, false
+	}
+	if inode != cp.Inode || size < cp.Offset {
+		return 0, true
+	}
+	// A file shorter than the fingerprint window keeps growing into it, so
+	// only compare fingerprints once both were taken over the full window.
+	if cp.Offset >= fingerprintSize && fingerprint != cp.Fingerprint {
+		return 0, true
+	}
+	return cp.Offset, false
+}
+
+// logTailer reads a log file from its checkpoint onwards and feeds every
+// complete line into the persisted aggregates.
+type logTailer struct {
+	source    Source
+	opts      Options
+	cachePath string
+	state     *cacheState
+	parser    *lineParser
+
+	file    *os.File
+	inode   uint64
+	offset  int64
+	pending []byte
+	minTs   float64
+}
+
+func newLogTailer(source Source, opts Options) (*logTailer, error) {
+	cachePath, err := cacheFilePath(source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := loadCacheState(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &cacheState{Filter: opts.Filter.String(), Aggregator: NewAggregator()}
+	}
+	state.Aggregator.configure(opts)
+
+	parser, err := newLineParser(source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logTailer{
+		source:    source,
+		opts:      opts,
+		cachePath: cachePath,
+		state:     state,
+		parser:    parser,
+	}, nil
+}
+
+// open opens the log path and positions the tailer where the checkpoint
+// says it should continue.
+func (t *logTailer) open() error {
+	file, err := os.Open(t.source.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	fingerprint, err := fileFingerprint(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to fingerprint file: %w", err)
+	}
+
+	inode := fileInode(info)
+	offset, restarted := resumeOffset(t.state.Checkpoint, inode, info.Size(), fingerprint)
+	if restarted && inode != t.state.Checkpoint.Inode {
+		if err := t.drainRotated(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if offset > 0 {
+		if err := t.primeFormat(file); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek file: %w", err)
+	}
+
+	// After a rotation or truncation the aggregates are kept, but anything
+	// older than what was already counted is skipped to avoid counting the
+	// same requests twice if old content shows up again.
+	t.minTs = 0
+	if restarted {
+		t.minTs = t.state.Checkpoint.LastTs
+	}
+
+	t.file = file
+	t.inode = inode
+	t.offset = offset
+	t.pending = nil
+	t.parser.line = 0
+	if offset > 0 {
+		t.parser.line = t.state.Checkpoint.Line
+	}
+	return nil
+}
+
+// drainRotated reads what was appended to the file of the checkpoint after
+// it was saved, when the log path has since been rotated to a new file.
+// The rotated file is looked for next to the log by its inode; once
+// compressed or removed, those lines are gone.
+func (t *logTailer) drainRotated() error {
+	cp := t.state.Checkpoint
+	if cp.Offset == 0 || cp.Inode == 0 {
+		return nil
+	}
+	dir := filepath.Dir(t.source.Path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list log directory: %w", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || fileInode(info) != cp.Inode || info.Size() < cp.Offset {
+			continue
+		}
+		file, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to open rotated file: %w", err)
+		}
+		fingerprint, err := fileFingerprint(file)
+		if err == nil && cp.Offset >= fingerprintSize && fingerprint != cp.Fingerprint {
+			file.Close()
+			continue
+		}
+		if err == nil {
+			err = t.drain(file, cp)
+		}
+		file.Close()
+		return err
+	}
+	return nil
+}
+
+// drain reads file from the checkpoint to its end. The file is no longer
+// written to, so a last line without its newline is complete.
+func (t *logTailer) drain(file *os.File, cp Checkpoint) error {
+	if err := t.primeFormat(file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(cp.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek rotated file: %w", err)
+	}
+	t.file, t.offset, t.pending, t.minTs = file, cp.Offset, nil, 0
+	t.parser.line = cp.Line
+	defer func() { t.file = nil }()
+
+	if err := t.readNew(); err != nil {
+		return err
+	}
+	if len(t.pending) > 0 {
+		line := t.pending
+		t.pending = nil
+		return t.process(bytes.TrimRight(line, "\r\n"))
+	}
+	return nil
+}
+
+// primeFormat replays the "#" directives at the top of a file that is
+// resumed mid-way, so formats that declare their columns in a header
+// (CloudFront) know the layout of the lines that follow.
+func (t *logTailer) primeFormat(file *os.File) error {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, 1<<20))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if !bytes.HasPrefix(line, []byte("#")) {
+			return nil
+		}
+		t.parser.format.Parse(bytes.TrimSpace(line))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read header: %w", err)
+		}
+	}
+}
+
+// readNew consumes every complete line appended since the last call.
+func (t *logTailer) readNew() error {
+	if err := t.readParallel(); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(t.file)
+	for {
+		chunk, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without its newline is still being written: keep it
+			// until the rest arrives.
+			t.pending = append(t.pending, chunk...)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read line: %w", err)
+		}
+
+		line := chunk
+		if len(t.pending) > 0 {
+			line = append(t.pending, chunk...)
+			t.pending = nil
+		}
+		t.offset += int64(len(line))
+
+		if err := t.process(bytes.TrimRight(line, "\r\n")); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *logTailer) process(line []byte) error {
+	logData, ok, err := t.parser.parse(line)
+	if err != nil || !ok {
+		return err
+	}
+	ts := float64(logData.Time.UnixNano()) / 1e9
+	if ts < t.minTs {
+		return nil
+	}
+	if ts > t.state.Checkpoint.LastTs {
+		t.state.Checkpoint.LastTs = ts
+	}
+
+	if t.opts.admit(&logData) && t.opts.Filter.Match(&logData) {
+		t.state.Aggregator.Add(logData)
+	}
+	return nil
+}
+
+// rotated reports whether the log path now points to a different file, or
+// the open file has been truncated below what was already read.
+func (t *logTailer) rotated() (bool, error) {
+	info, err := os.Stat(t.source.Path)
+	if os.IsNotExist(err) {
+		// Between a rename and the creation of the new file: keep reading
+		// the old one until the new one shows up.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if fileInode(info) != t.inode {
+		return true, nil
+	}
+	return info.Size() < t.offset, nil
+}
+
+// reopen switches to the file now found at the log path. A truncated or
+// freshly rotated file is read from the start.
+func (t *logTailer) reopen() error {
+	t.file.Close()
+	t.state.Checkpoint.Offset = 0
+	if err := t.open(); err != nil {
+		return err
+	}
+	t.minTs = 0
+	return nil
+}
+
+// save persists the aggregates together with the current checkpoint. A
+// network source has no file to checkpoint, only its aggregates.
+func (t *logTailer) save() error {
+	t.state.Checkpoint.Path = t.source.Path
+	if t.file != nil {
+		fingerprint, err := fileFingerprint(t.file)
+		if err != nil {
+			return fmt.Errorf("failed to fingerprint file: %w", err)
+		}
+		t.state.Checkpoint.Inode = t.inode
+		t.state.Checkpoint.Fingerprint = fingerprint
+		t.state.Checkpoint.Offset = t.offset
+	}
+	t.state.Checkpoint.Line = t.parser.line
+	t.state.Filter = t.opts.Filter.String()
+	return saveCacheState(t.cachePath, t.state)
+}
+
+func (t *logTailer) Close() error {
+	t.parser.Close()
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
+
+// IncrementalResult digests only the part of the source log that was appended
+// since the previous run, merges it into the persisted daily aggregates in
+// opts.CacheDir and returns the up-to-date counts, together with the
+// statistics of the lines read in this run. Records are filtered by URI
+// with the same rules as FilterLogData; date filtering is left to
+// FilterResult, so that one cache serves every --last window.
+func IncrementalResult(sources []Source, opts Options) (Result, ParseStats, error) {
+	agg, stats, err := IncrementalAggregate(sources, opts)
+	if err != nil {
+		return Result{}, stats, err
+	}
+	return agg.Result(), stats, nil
+}
+
+// IncrementalAggregate is IncrementalResult returning the merged
+// aggregates themselves, for reports that need more than daily counts.
+func IncrementalAggregate(sources []Source, opts Options) (*Aggregator, ParseStats, error) {
+	merged := NewAggregator()
+	var stats ParseStats
+	for _, source := range sources {
+		agg, sourceStats, err := incrementalAggregate(source, opts)
+		stats = stats.Add(sourceStats)
+		if err != nil {
+			return nil, stats, fmt.Errorf("%s: %w", source.Path, err)
+		}
+		merged.Merge(agg)
+	}
+	return merged, stats, nil
+}
+
+func incrementalAggregate(source Source, opts Options) (*Aggregator, ParseStats, error) {
+	if _, _, ok := source.Network(); ok {
+		return collectedAggregate(source, opts)
+	}
+	tailer, err := newLogTailer(source, opts)
+	if err != nil {
+		return nil, ParseStats{}, err
+	}
+	defer tailer.Close()
+	if err := tailer.open(); err != nil {
+		return nil, ParseStats{}, err
+	}
+
+	if err := tailer.readNew(); err != nil {
+		return nil, tailer.parser.Stats, err
+	}
+	if err := tailer.save(); err != nil {
+		return nil, tailer.parser.Stats, err
+	}
+	return tailer.state.Aggregator, tailer.parser.Stats, nil
+}
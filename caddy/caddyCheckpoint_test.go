@@ -0,0 +1,105 @@
+package caddy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeOffset(t *testing.T) {
+	cp := Checkpoint{Inode: 7, Fingerprint: "head", Offset: 1000}
+	tests := []struct {
+		name        string
+		cp          Checkpoint
+		inode       uint64
+		size        int64
+		fingerprint string
+		offset      int64
+		restarted   bool
+	}{
+		{"first run", Checkpoint{}, 7, 5000, "head", 0, false},
+		{"same file", cp, 7, 1000, "head", 1000, false},
+		{"grown", cp, 7, 5000, "head", 1000, false},
+		{"truncated", cp, 7, 500, "head", 0, true},
+		{"changed fingerprint", cp, 7, 5000, "other", 0, true},
+		{"fingerprint window still filling", Checkpoint{Inode: 7, Fingerprint: "head", Offset: 100}, 7, 500, "other", 100, false},
+		{"rotated", cp, 8, 5000, "head", 0, true},
+		{"rotated to a smaller file", cp, 8, 10, "other", 0, true},
+	}
+	for _, test := range tests {
+		offset, restarted := resumeOffset(test.cp, test.inode, test.size, test.fingerprint)
+		if offset != test.offset || restarted != test.restarted {
+			t.Errorf("%s: resumed at %d (restarted %v), want %d (%v)", test.name, offset, restarted, test.offset, test.restarted)
+		}
+	}
+}
+
+// accessLine is a Caddy JSON log line for a request of /e<n>.mp3, logged
+// at a minute past start per n so that every line is its own stream.
+func accessLine(start time.Time, n int) string {
+	return fmt.Sprintf(`{"ts":%d,"request":{"remote_ip":"81.2.69.1","method":"GET","host":"pod.example.com","uri":"/e%d.mp3","headers":{"User-Agent":["Overcast/3.0"]}},"status":200,"size":1000}`+"\n",
+		start.Add(time.Duration(n)*time.Minute).Unix(), n)
+}
+
+// appendLines writes the lines from first to last (exclusive) to path.
+func appendLines(t *testing.T, path string, start time.Time, first, last int) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for n := first; n < last; n++ {
+		if _, err := file.WriteString(accessLine(start, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// streams totals the streams of every day.
+func streams(result Result) int {
+	total := 0
+	for _, ts := range result.TimeSeries {
+		total += ts.All.Streams
+	}
+	return total
+}
+
+// TestIncrementalRotated appends to a log after a run and rotates it
+// before the next: that run reads the end of the rotated file, then the
+// new one, and counts every line once.
+func TestIncrementalRotated(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	opts := Options{CacheDir: filepath.Join(dir, "cache")}
+	sources := []Source{{Path: logPath, Format: "caddy"}}
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.Local)
+
+	appendLines(t, logPath, start, 0, 10)
+	if result, _, err := IncrementalResult(sources, opts); err != nil || streams(result) != 10 {
+		t.Fatalf("first run: %d streams (%v), want 10", streams(result), err)
+	}
+
+	appendLines(t, logPath, start, 10, 15)
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, logPath, start, 15, 20)
+	result, stats, err := IncrementalResult(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := streams(result); got != 20 {
+		t.Errorf("after the rotation: %d streams, want 20", got)
+	}
+	if stats.Read != 10 {
+		t.Errorf("after the rotation: read %d lines, want the 10 new ones", stats.Read)
+	}
+
+	// Nothing new: nothing is counted again
+	if result, _, err = IncrementalResult(sources, opts); err != nil || streams(result) != 20 {
+		t.Errorf("third run: %d streams (%v), want 20", streams(result), err)
+	}
+}
@@ -0,0 +1,134 @@
+package caddy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// privateRanges is what "private_ranges" stands for in a trusted proxy
+// list, as in Caddy's own trusted_proxies setting.
+var privateRanges = []string{
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"::1/128", "fc00::/7",
+}
+
+// TrustedProxies lists the networks of the proxies whose forwarding
+// headers are believed. Headers sent by anyone else are ignored, since
+// clients can set them to anything.
+type TrustedProxies struct {
+	networks []*net.IPNet
+	spec     string
+}
+
+// ParseTrustedProxies reads a comma or space separated list of CIDRs and
+// addresses; "private_ranges" adds the loopback and private networks.
+func ParseTrustedProxies(spec string) (*TrustedProxies, error) {
+	proxies := &TrustedProxies{}
+	var normalized []string
+	for _, field := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		cidrs := []string{field}
+		if field == "private_ranges" {
+			cidrs = privateRanges
+		}
+		for _, cidr := range cidrs {
+			if !strings.Contains(cidr, "/") {
+				ip := net.ParseIP(cidr)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid trusted proxy %q: not an address or CIDR", cidr)
+				}
+				if ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			proxies.networks = append(proxies.networks, network)
+			normalized = append(normalized, network.String())
+		}
+	}
+	proxies.spec = strings.Join(normalized, ",")
+	return proxies, nil
+}
+
+// String lists the trusted networks, identifying the setting in cache
+// names.
+func (t *TrustedProxies) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.spec
+}
+
+// trusts reports whether ip belongs to a trusted proxy. A nil list trusts
+// nobody.
+func (t *TrustedProxies) trusts(ip net.IP) bool {
+	if t == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHop reads one address of a forwarding header, with or without a
+// port ("1.2.3.4:5678", "[2001:db8::1]:443").
+func parseHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// ClientIP resolves the address of the client behind a request. Starting
+// from the connection address, X-Forwarded-For is walked from the right,
+// past the trusted proxies, and the first untrusted hop is the client;
+// X-Real-Ip is only used when a trusted proxy sent no X-Forwarded-For.
+// When the log does not record the connection address, the headers are all
+// there is and get walked the same way. When none of them is an address,
+// the connection address is returned as logged: in lines archived with
+// anonymization, it is the pseudonym of the client (see Anonymizer.redact).
+func (t *TrustedProxies) ClientIP(entry LogData) string {
+	peer := parseHop(entry.RemoteIP)
+	if peer != nil && !t.trusts(peer) {
+		return peer.String()
+	}
+
+	client, forwarded := peer, false
+	hops := strings.Split(entry.ForwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if strings.TrimSpace(hops[i]) == "" {
+			continue
+		}
+		ip := parseHop(hops[i])
+		if ip == nil {
+			// Garbage past a trusted proxy: keep the last good address
+			break
+		}
+		client, forwarded = ip, true
+		if !t.trusts(ip) {
+			break
+		}
+	}
+
+	if !forwarded {
+		if ip := parseHop(entry.XRealIP); ip != nil {
+			client = ip
+		}
+	}
+	if client == nil {
+		return strings.TrimSpace(entry.RemoteIP)
+	}
+	return client.String()
+}
@@ -0,0 +1,74 @@
+package caddy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 2001:db8:ffff::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		entry     LogData
+		client    string
+		unproxied string // The client without trusted proxies, when it differs
+	}{
+		{"untrusted peer", LogData{RemoteIP: "81.2.69.1", ForwardedFor: "1.1.1.1", XRealIP: "1.1.1.2"}, "81.2.69.1", ""},
+		{"trusted chain", LogData{RemoteIP: "10.0.0.1", ForwardedFor: "81.2.69.1, 10.0.0.3, 10.0.0.2"}, "81.2.69.1", "10.0.0.1"},
+		{"spoofed first hop", LogData{RemoteIP: "10.0.0.1", ForwardedFor: "1.1.1.1, 81.2.69.1, 10.0.0.2"}, "81.2.69.1", "10.0.0.1"},
+		{"header per hop", LogData{RemoteIP: "10.0.0.1", ForwardedFor: "81.2.69.1,10.0.0.2"}, "81.2.69.1", "10.0.0.1"},
+		{"only proxies", LogData{RemoteIP: "10.0.0.1", ForwardedFor: "10.0.0.5, 10.0.0.2"}, "10.0.0.5", "10.0.0.1"},
+		{"X-Real-Ip from a proxy", LogData{RemoteIP: "10.0.0.1", XRealIP: "81.2.69.1"}, "81.2.69.1", "10.0.0.1"},
+		{"X-Forwarded-For over X-Real-Ip", LogData{RemoteIP: "10.0.0.1", ForwardedFor: "81.2.69.2", XRealIP: "81.2.69.1"}, "81.2.69.2", "10.0.0.1"},
+		{"no connection address", LogData{ForwardedFor: "81.2.69.1, 10.0.0.2"}, "81.2.69.1", "10.0.0.2"},
+
+		// Malformed entries
+		{"garbage past a proxy", LogData{RemoteIP: "10.0.0.1", ForwardedFor: "81.2.69.1, unknown, 10.0.0.2"}, "10.0.0.2", "10.0.0.1"},
+		{"empty hops", LogData{RemoteIP: "10.0.0.1", ForwardedFor: " ,81.2.69.1,, 10.0.0.2, "}, "81.2.69.1", "10.0.0.1"},
+		{"garbage connection address", LogData{RemoteIP: "unknown", ForwardedFor: "81.2.69.1"}, "81.2.69.1", ""},
+		{"garbage X-Real-Ip", LogData{RemoteIP: "10.0.0.1", XRealIP: "unknown"}, "10.0.0.1", ""},
+		// Pseudonyms of a line archived with anonymization
+		{"no address at all", LogData{RemoteIP: "5f0e3c", ForwardedFor: "5f0e3c, 5f0e3c"}, "5f0e3c", ""},
+
+		// Ports and IPv6
+		{"IPv4 with port", LogData{RemoteIP: "10.0.0.1:51234", ForwardedFor: "81.2.69.1:5678"}, "81.2.69.1", "10.0.0.1"},
+		{"IPv6 peer with port", LogData{RemoteIP: "[2001:db8::1]:443"}, "2001:db8::1", ""},
+		{"IPv6 behind an IPv6 proxy", LogData{RemoteIP: "[2001:db8:ffff::1]:443", ForwardedFor: "[2001:db8:1::5]:51234"}, "2001:db8:1::5", "2001:db8:ffff::1"},
+		{"IPv6 chain without ports", LogData{RemoteIP: "2001:db8:ffff::1", ForwardedFor: "2001:db8:1::5, 2001:db8:ffff::2"}, "2001:db8:1::5", "2001:db8:ffff::1"},
+		{"IPv4 behind an IPv6 proxy", LogData{RemoteIP: "[2001:db8:ffff::1]:443", XRealIP: "81.2.69.1"}, "81.2.69.1", "2001:db8:ffff::1"},
+	}
+	for _, test := range tests {
+		if got := proxies.ClientIP(test.entry); got != test.client {
+			t.Errorf("%s: client %q, want %q", test.name, got, test.client)
+		}
+		want := test.unproxied
+		if want == "" {
+			want = test.client
+		}
+		var none *TrustedProxies
+		if got := none.ClientIP(test.entry); got != want {
+			t.Errorf("%s without trusted proxies: client %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies("private_ranges 203.0.113.7,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"10.0.0.0/8", "192.168.0.0/16", "fc00::/7", "203.0.113.7/32", "2001:db8::/32"} {
+		if !strings.Contains(","+proxies.String()+",", ","+want+",") {
+			t.Errorf("trusted %s, want %s among them", proxies, want)
+		}
+	}
+
+	for _, spec := range []string{"10.0.0.0/33", "proxy.example.com", "10.0.0"} {
+		if _, err := ParseTrustedProxies(spec); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package caddy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDatagram is the largest UDP datagram read, more than any log line.
+const maxDatagram = 64 << 10
+
+// received is one line that arrived on a collected source.
+type received struct {
+	tailer *logTailer
+	line   []byte
+}
+
+// Archive keeps the raw lines received by collect, in one file per source
+// and day ("tcp_127.0.0.1_9000-2024-06-01.log"). The lines are archived as
+// received, client addresses included, so the files are only readable by
+// their owner, or with anonymization with their addresses replaced (see
+// logTailer.archived); files older than keep days are removed, unless keep
+// is 0.
+type Archive struct {
+	dir    string
+	prefix string
+	keep   int
+
+	date   string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// archivePrefix names the archive files of a source after its address.
+func archivePrefix(source Source) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.Replace(source.Path, "://", "_", 1))
+}
+
+// archiveFiles lists the archive files of a source, oldest first.
+func archiveFiles(dir string, source Source) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, archivePrefix(source)+"-*.log"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archive: %w", err)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func newArchive(dir string, source Source, keep int) *Archive {
+	return &Archive{dir: dir, prefix: archivePrefix(source), keep: keep}
+}
+
+// Write appends line to the file of the day it was received on, switching
+// files at midnight.
+func (a *Archive) Write(line []byte, now time.Time) error {
+	if date := now.Format("2006-01-02"); date != a.date {
+		if err := a.rotate(date); err != nil {
+			return err
+		}
+	}
+	if _, err := a.writer.Write(line); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return a.writer.WriteByte('\n')
+}
+
+// rotate closes the current file, opens the one of date and removes the
+// files past the retention.
+func (a *Archive) rotate(date string) error {
+	if err := a.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	path := filepath.Join(a.dir, a.prefix+"-"+date+".log")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	a.date, a.file, a.writer = date, file, bufio.NewWriterSize(file, 1<<16)
+
+	if a.keep <= 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(a.dir, a.prefix+"-*.log"))
+	if err != nil {
+		return fmt.Errorf("failed to list archive: %w", err)
+	}
+	sort.Strings(paths)
+	for len(paths) > a.keep {
+		if err := os.Remove(paths[0]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove archive: %w", err)
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// Flush writes the buffered lines out, so that readers of the archive see
+// everything received so far.
+func (a *Archive) Flush() error {
+	if a.writer == nil {
+		return nil
+	}
+	if err := a.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+func (a *Archive) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.Flush()
+	if cerr := a.file.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to close archive: %w", cerr)
+	}
+	a.file, a.writer, a.date = nil, nil, ""
+	return err
+}
+
+// Collect listens on the network sources ("tcp://127.0.0.1:9000",
+// "udp://:9001") for newline-delimited log lines, as sent by Caddy's net
+// log writer, and digests them as they arrive exactly as the lines of a
+// log file: same parser, same admission and filter, same aggregates, which
+// are persisted in opts.CacheDir every interval and once more when ctx is
+// cancelled. With opts.ArchiveDir set, the lines are also kept in a daily
+// archive (see Archive), which later runs read back in place of the
+// network source. report, when not nil, is handed the running statistics
+// after every save.
+func Collect(ctx context.Context, sources []Source, opts Options, interval time.Duration, report func(ParseStats)) (ParseStats, error) {
+	var tailers []*logTailer
+	archives := make(map[*logTailer]*Archive)
+	stats := func() ParseStats {
+		var total ParseStats
+		for _, tailer := range tailers {
+			total = total.Add(tailer.parser.Stats)
+		}
+		return total
+	}
+	defer func() {
+		for _, tailer := range tailers {
+			tailer.Close()
+		}
+	}()
+
+	for _, source := range sources {
+		if _, _, ok := source.Network(); !ok {
+			return stats(), fmt.Errorf("%s: not a network address (tcp://host:port or udp://host:port)", source.Path)
+		}
+		tailer, err := newLogTailer(source, opts)
+		if err != nil {
+			return stats(), err
+		}
+		tailers = append(tailers, tailer)
+		tailer.parser.line = tailer.state.Checkpoint.Line
+		if err := saveCollectSettings(source, opts); err != nil {
+			return stats(), err
+		}
+		if opts.ArchiveDir != "" {
+			archive := newArchive(opts.ArchiveDir, source, opts.ArchiveKeep)
+			archives[tailer] = archive
+			defer archive.Close()
+		}
+	}
+
+	listenCtx, stopListening := context.WithCancel(ctx)
+	var listeners sync.WaitGroup
+	defer listeners.Wait()
+	defer stopListening()
+
+	lines := make(chan received, 1024)
+	errs := make(chan error, len(tailers))
+	for _, tailer := range tailers {
+		stop, err := listen(listenCtx, tailer, lines, errs, &listeners)
+		if err != nil {
+			return stats(), fmt.Errorf("%s: %w", tailer.source.Path, err)
+		}
+		go func() {
+			<-listenCtx.Done()
+			stop()
+		}()
+	}
+
+	save := func() error {
+		for _, tailer := range tailers {
+			if archive := archives[tailer]; archive != nil {
+				if err := archive.Flush(); err != nil {
+					return err
+				}
+			}
+			if err := tailer.save(); err != nil {
+				return err
+			}
+		}
+		if report != nil {
+			report(stats())
+		}
+		return nil
+	}
+
+	digest := func(r received) error {
+		if archive := archives[r.tailer]; archive != nil {
+			if line, ok := r.tailer.archived(r.line); ok {
+				if err := archive.Write(line, time.Now()); err != nil {
+					return err
+				}
+			}
+		}
+		if err := r.tailer.process(r.line); err != nil {
+			return fmt.Errorf("%s: %w", r.tailer.source.Path, err)
+		}
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Lines already received are not lost to the shutdown
+			for len(lines) > 0 {
+				if err := digest(<-lines); err != nil {
+					return stats(), err
+				}
+			}
+			return stats(), save()
+
+		case err := <-errs:
+			if serr := save(); serr != nil {
+				return stats(), serr
+			}
+			return stats(), err
+
+		case r := <-lines:
+			if err := digest(r); err != nil {
+				return stats(), err
+			}
+
+		case <-ticker.C:
+			if err := save(); err != nil {
+				return stats(), err
+			}
+		}
+	}
+}
+
+// archived returns a received line as it is archived: unchanged, or with
+// anonymization, with its client addresses replaced by the pseudonym of
+// the client (see Anonymizer.redact). Lines that cannot be decoded are
+// then left out, as from the quarantine: there is no telling where their
+// addresses are.
+func (t *logTailer) archived(line []byte) ([]byte, bool) {
+	if t.opts.Anonymizer == nil {
+		return line, true
+	}
+	entry, err := t.parser.format.Parse(bytes.TrimSpace(line))
+	if err == errSkipLine {
+		return line, true
+	}
+	if err != nil {
+		return nil, false
+	}
+	return t.opts.Anonymizer.redact(line, entry, t.opts.Proxies.ClientIP(entry)), true
+}
+
+// listen opens the address of a network source and hands every line
+// received on it to lines, until ctx is cancelled. An error that stops
+// the listener goes to errs. The returned stop closes the listener and
+// any open connection.
+func listen(ctx context.Context, tailer *logTailer, lines chan<- received, errs chan<- error, wg *sync.WaitGroup) (stop func(), err error) {
+	network, address, _ := tailer.source.Network()
+	send := func(line []byte) bool {
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			return true
+		}
+		select {
+		case lines <- received{tailer: tailer, line: bytes.Clone(line)}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	fail := func(err error) {
+		if ctx.Err() == nil {
+			errs <- fmt.Errorf("%s: %w", tailer.source.Path, err)
+		}
+	}
+
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, maxDatagram)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					fail(fmt.Errorf("failed to receive: %w", err))
+					return
+				}
+				// A datagram holds one line or more
+				for _, line := range bytes.Split(buf[:n], []byte{'\n'}) {
+					if !send(line) {
+						return
+					}
+				}
+			}
+		}()
+		return func() { conn.Close() }, nil
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	stop = func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					fail(fmt.Errorf("failed to accept: %w", err))
+				}
+				return
+			}
+			mu.Lock()
+			if ctx.Err() != nil {
+				mu.Unlock()
+				conn.Close()
+				return
+			}
+			conns[conn] = struct{}{}
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() {
+					mu.Lock()
+					delete(conns, conn)
+					mu.Unlock()
+					conn.Close()
+				}()
+				// A connection dropped mid-line loses only that line
+				reader := bufio.NewReaderSize(conn, 1<<16)
+				for {
+					line, err := reader.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					if !send(line) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return stop, nil
+}
+
+// collectSettingsPath is where collect records the settings it counts a
+// network source with.
+func collectSettingsPath(source Source, opts Options) string {
+	return filepath.Join(opts.CacheDir, "collect-"+archivePrefix(source)+".json")
+}
+
+// saveCollectSettings records the cacheSettings collect counts source with,
+// so that runs with other options can tell what differs.
+func saveCollectSettings(source Source, opts Options) error {
+	content, err := json.Marshal(cacheSettings(opts))
+	if err != nil {
+		return fmt.Errorf("failed to marshal collect settings: %w", err)
+	}
+	if err := os.MkdirAll(opts.CacheDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err := os.WriteFile(collectSettingsPath(source, opts), content, 0o600); err != nil {
+		return fmt.Errorf("failed to write collect settings: %w", err)
+	}
+	return nil
+}
+
+// collectMismatch explains why no aggregates of source match opts: the
+// settings collect counts with that differ, or that nothing was collected.
+func collectMismatch(source Source, opts Options) error {
+	content, err := os.ReadFile(collectSettingsPath(source, opts))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("nothing collected in %s yet", opts.CacheDir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read collect settings: %w", err)
+	}
+	var collected map[string]string
+	if err := json.Unmarshal(content, &collected); err != nil {
+		return fmt.Errorf("failed to unmarshal collect settings: %w", err)
+	}
+
+	settings := cacheSettings(opts)
+	var names []string
+	for name := range collected {
+		if settings[name] != collected[name] {
+			names = append(names, name)
+		}
+	}
+	for name := range settings {
+		if _, ok := collected[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	show := func(name, value string) string {
+		switch {
+		case value == "":
+			return "off"
+		case name == "anonymization":
+			// A digest of the key: only whether it is the same matters
+			return "key " + value[:8]
+		case name == "feed":
+			return "episodes " + value[:8]
+		}
+		return value
+	}
+	differences := make([]string, len(names))
+	for i, name := range names {
+		differences[i] = fmt.Sprintf("%s %s instead of %s", name, show(name, settings[name]), show(name, collected[name]))
+	}
+	return fmt.Errorf("collect counts with other options (%s): run with the same options, or set COLLECT_ARCHIVE_DIR for collect to keep the lines",
+		strings.Join(differences, ", "))
+}
+
+// collectedAggregate returns the aggregates of a network source. With an
+// archive its files are digested like any log, each with its own cache, so
+// that every filter and option works; without one only the aggregates
+// collect persisted are there, which it leaves untouched for collect to
+// carry on with, and options other than collect's are an error.
+func collectedAggregate(source Source, opts Options) (*Aggregator, ParseStats, error) {
+	if opts.ArchiveDir != "" {
+		paths, err := archiveFiles(opts.ArchiveDir, source)
+		if err != nil {
+			return nil, ParseStats{}, err
+		}
+		merged := NewAggregator()
+		var stats ParseStats
+		for _, path := range paths {
+			agg, fileStats, err := incrementalAggregate(Source{Path: path, Format: source.Format}, opts)
+			stats = stats.Add(fileStats)
+			if err != nil {
+				return nil, stats, fmt.Errorf("%s: %w", path, err)
+			}
+			merged.Merge(agg)
+		}
+		return merged, stats, nil
+	}
+
+	tailer, err := newLogTailer(source, opts)
+	if err != nil {
+		return nil, ParseStats{}, err
+	}
+	defer tailer.Close()
+	if _, err := os.Stat(tailer.cachePath); errors.Is(err, os.ErrNotExist) {
+		if err := collectMismatch(source, opts); err != nil {
+			return nil, ParseStats{}, err
+		}
+	}
+	return tailer.state.Aggregator, tailer.parser.Stats, nil
+}
+
+// readArchive is ReadLogData for a network source: the archived lines, in
+// the order they were received.
+func readArchive(source Source, opts Options, parser *lineParser) ([]LogData, error) {
+	if opts.ArchiveDir == "" {
+		return nil, fmt.Errorf("%s: network sources can only be read back from the collect archive, set COLLECT_ARCHIVE_DIR", source.Path)
+	}
+	paths, err := archiveFiles(opts.ArchiveDir, source)
+	if err != nil {
+		return nil, err
+	}
+	var logDataList []LogData
+	for _, path := range paths {
+		logEntries, err := ingestDataFromFile(path, parser)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range logEntries {
+			if opts.admit(&entry) {
+				logDataList = append(logDataList, entry)
+			}
+		}
+	}
+	return logDataList, nil
+}
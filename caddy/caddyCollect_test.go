@@ -0,0 +1,106 @@
+package caddy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCollectArchiveAnonymized sends lines to collect over TCP with
+// addresses anonymized: the archive keeps them without any address, and
+// read back they count as the lines received.
+func TestCollectArchiveAnonymized(t *testing.T) {
+	dir := t.TempDir()
+	anonymizer, err := LoadAnonymizer(filepath.Join(dir, "anonymize.key"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		CacheDir:   filepath.Join(dir, "cache"),
+		ArchiveDir: filepath.Join(dir, "archive"),
+		Anonymizer: anonymizer,
+		Proxies:    proxies,
+	}
+
+	port, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := Source{Path: "tcp://" + port.Addr().String(), Format: "caddy"}
+	port.Close()
+
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local).Unix()
+	line := func(offset int64, client string) string {
+		return fmt.Sprintf(`{"ts":%d,"request":{"remote_ip":"10.0.0.2","remote_port":"51234","client_ip":"%s","method":"GET","host":"pod.example.com","uri":"/e1.mp3","headers":{"User-Agent":["Overcast/3.0"],"X-Forwarded-For":["%s, 10.0.0.1"]}},"status":200,"size":1000}`,
+			ts+offset, client, client)
+	}
+	lines := []string{line(0, "81.2.69.1"), line(60, "81.2.69.1"), line(120, "81.2.69.12"), "not a log line"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Collect(ctx, []Source{source}, opts, 10*time.Millisecond, nil)
+		done <- err
+	}()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", strings.TrimPrefix(source.Path, "tcp://")); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, strings.Join(lines, "\n")+"\n")
+	conn.Close()
+
+	var archived []byte
+	for deadline := time.Now().Add(5 * time.Second); strings.Count(string(archived), "\n") < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("archive has %q, want 3 lines", archived)
+		}
+		paths, _ := archiveFiles(opts.ArchiveDir, source)
+		if len(paths) == 1 {
+			archived, _ = os.ReadFile(paths[0])
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{"81.2.69", "10.0.0", "not a log line"} {
+		if strings.Contains(string(archived), address) {
+			t.Errorf("archive keeps %q:\n%s", address, archived)
+		}
+	}
+
+	data, _, err := ReadLogData(source, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3 {
+		t.Fatalf("read back %d records, want 3", len(data))
+	}
+	if data[0].RealIP != data[1].RealIP || data[0].RealIP == data[2].RealIP {
+		t.Errorf("read back clients %q, %q and %q, want the first two the same", data[0].RealIP, data[1].RealIP, data[2].RealIP)
+	}
+	agg, _, err := IncrementalAggregate([]Source{source}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := agg.Result().TimeSeries[0].All.Listeners; got != 2 {
+		t.Errorf("%d listeners read back from the archive, want 2", got)
+	}
+}
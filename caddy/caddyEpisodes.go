@@ -0,0 +1,189 @@
+package caddy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// firstWeek is the period after publication reported separately by
+// Episodes.
+const firstWeek = 7 * 24 * time.Hour
+
+// episodeKey names what a request is for: the feed item its URI points to
+// when a feed is configured, otherwise the URI on its virtual host.
+func episodeKey(entry LogData) string {
+	if entry.Episode != nil {
+		return entry.Episode.GUID
+	}
+	return entry.Host + entry.URI
+}
+
+// Keyword reports whether a bare --filter word designates the record: its
+// episode (see rss.Episode.Matches), or part of its URI when the request is
+// not for a feed item.
+func (entry *LogData) Keyword(word string) bool {
+	if entry.Episode != nil {
+		return entry.Episode.Matches(word)
+	}
+	return strings.Contains(entry.URI, word)
+}
+
+// Field returns what a filter query can test about a record; the episode
+// fields come from the feed.
+func (entry *LogData) Field(name string) (string, bool) {
+	var value string
+	switch name {
+	case "season", "episode", "title", "guid", "published":
+		if entry.Episode == nil {
+			return "", false
+		}
+		return entry.Episode.Field(name)
+	case "uri":
+		value = entry.URI
+	case "host":
+		value = entry.Host
+	case "show":
+		value = entry.Show
+	case "referer":
+		value = entry.Referer
+	case "kind":
+		value = entry.Kind
+	case "method":
+		value = entry.Method
+	case "status":
+		if entry.Status == 0 {
+			return "", false
+		}
+		return strconv.Itoa(entry.Status), true
+	case "app":
+		value = entry.App
+	case "device":
+		value = entry.Device
+	case "os":
+		value = entry.OS
+	case "category":
+		value = entry.Category
+		if value == "" {
+			value = classifyUserAgent(entry.UserAgent)
+		}
+	case "country":
+		value = entry.Country
+	case "region":
+		value = entry.Region
+	case "city":
+		value = entry.City
+	case "ua":
+		value = entry.UserAgent
+	}
+	return value, value != ""
+}
+
+// EpisodeReport is the audience of one episode. Requests that matched no
+// feed item are reported by URI path, without a title.
+type EpisodeReport struct {
+	Season    int    `json:"season,omitempty"`
+	Number    int    `json:"episode,omitempty"`
+	Published string `json:"published,omitempty"` // Publication date (YYYY-MM-DD)
+	Title     string `json:"title,omitempty"`
+	GUID      string `json:"guid,omitempty"`
+	URI       string `json:"uri,omitempty"`
+	Streams   int    `json:"streams"`
+	Listeners int    `json:"listeners"`
+	FirstWeek int    `json:"streamsFirstWeek"` // Streams within 7 days of publication
+
+	Page *PageCounts `json:"page,omitempty"` // Views of the episode web page (the item link)
+}
+
+// Episodes counts streams (per day, as in the time series) and distinct
+// listeners per episode, and the views and visitors of its web page. Feed
+// items come first, in publication order.
+func Episodes(data []LogData) []EpisodeReport {
+	type sets struct {
+		report    *EpisodeReport
+		published time.Time
+		streams   map[string]struct{}
+		firstWeek map[string]struct{}
+		listeners map[string]struct{}
+		visitors  map[string]struct{}
+		views     int
+	}
+
+	episodes := make(map[string]*sets)
+	for _, entry := range data {
+		page := pageView(entry) && entry.Episode != nil
+		if !page && !countable(entry) {
+			continue
+		}
+
+		key := episodeKey(entry)
+		if entry.Episode == nil {
+			key, _, _ = strings.Cut(key, "?")
+		}
+		s, ok := episodes[key]
+		if !ok {
+			s = &sets{
+				report:    &EpisodeReport{URI: key},
+				streams:   make(map[string]struct{}),
+				firstWeek: make(map[string]struct{}),
+				listeners: make(map[string]struct{}),
+				visitors:  make(map[string]struct{}),
+			}
+			if ep := entry.Episode; ep != nil {
+				s.published = ep.Published
+				s.report = &EpisodeReport{Season: ep.Season, Number: ep.Number, Title: ep.Title, GUID: ep.GUID}
+				if !ep.Published.IsZero() {
+					s.report.Published = ep.Published.Format("2006-01-02")
+				}
+			}
+			episodes[key] = s
+		}
+
+		listenerKey := entry.RealIP + entry.UserAgent
+		if page {
+			s.views++
+			s.visitors[listenerKey] = struct{}{}
+			continue
+		}
+		streamKey := entry.Timestamp[:10] + listenerKey
+		s.streams[streamKey] = struct{}{}
+		s.listeners[listenerKey] = struct{}{}
+		if !s.published.IsZero() && entry.Time.Before(s.published.Add(firstWeek)) {
+			s.firstWeek[streamKey] = struct{}{}
+		}
+	}
+
+	all := make([]*sets, 0, len(episodes))
+	for _, s := range episodes {
+		s.report.Streams = len(s.streams)
+		s.report.Listeners = len(s.listeners)
+		s.report.FirstWeek = len(s.firstWeek)
+		if s.views > 0 {
+			s.report.Page = &PageCounts{Views: s.views, Visitors: len(s.visitors)}
+		}
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if (a.report.GUID == "") != (b.report.GUID == "") {
+			return a.report.GUID != ""
+		}
+		if !a.published.Equal(b.published) {
+			return a.published.Before(b.published)
+		}
+		if a.report.Title != b.report.Title {
+			return a.report.Title < b.report.Title
+		}
+		if a.report.GUID != b.report.GUID {
+			return a.report.GUID < b.report.GUID
+		}
+		return a.report.URI < b.report.URI
+	})
+
+	result := make([]EpisodeReport, 0, len(all))
+	for _, s := range all {
+		result = append(result, *s.report)
+	}
+	return result
+}
@@ -0,0 +1,121 @@
+package caddy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// pollInterval is how often a followed log is checked for new lines.
+const pollInterval = 250 * time.Millisecond
+
+// Follow keeps reading the source logs as they grow, like `tail -F`: it
+// survives rotation and truncation, and every interval hands the running
+// aggregates of all sources, merged, to emit. Checkpoints and aggregates are
+// saved on every update and once more when ctx is cancelled, so a later run
+// (followed or not) picks up exactly where this one stopped. The returned
+// statistics cover every line read while following.
+func Follow(ctx context.Context, sources []Source, opts Options, interval time.Duration, emit func(*Aggregator) error) (ParseStats, error) {
+	var tailers []*logTailer
+	stats := func() ParseStats {
+		var total ParseStats
+		for _, tailer := range tailers {
+			total = total.Add(tailer.parser.Stats)
+		}
+		return total
+	}
+	defer func() {
+		for _, tailer := range tailers {
+			tailer.Close()
+		}
+	}()
+
+	for _, source := range sources {
+		if _, _, ok := source.Network(); ok {
+			return stats(), fmt.Errorf("%s: network sources are received by collect, not followed", source.Path)
+		}
+		tailer, err := newLogTailer(source, opts)
+		if err != nil {
+			return stats(), err
+		}
+		tailers = append(tailers, tailer)
+		if err := tailer.open(); err != nil {
+			return stats(), fmt.Errorf("%s: %w", source.Path, err)
+		}
+	}
+
+	err := follow(ctx, tailers, interval, emit)
+	return stats(), err
+}
+
+func follow(ctx context.Context, tailers []*logTailer, interval time.Duration, emit func(*Aggregator) error) error {
+	update := func() error {
+		merged := NewAggregator()
+		for _, tailer := range tailers {
+			if err := tailer.save(); err != nil {
+				return err
+			}
+			merged.Merge(tailer.state.Aggregator)
+		}
+		return emit(merged)
+	}
+
+	for _, tailer := range tailers {
+		if err := tailer.readNew(); err != nil {
+			return err
+		}
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, tailer := range tailers {
+				if err := tailer.save(); err != nil {
+					return err
+				}
+			}
+			return nil
+
+		case <-poll.C:
+			for _, tailer := range tailers {
+				if err := pollTailer(tailer); err != nil {
+					return fmt.Errorf("%s: %w", tailer.source.Path, err)
+				}
+			}
+
+		case <-ticker.C:
+			if err := update(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// pollTailer reads what was appended to one log and switches to the new file
+// when the log has been rotated.
+func pollTailer(tailer *logTailer) error {
+	if err := tailer.readNew(); err != nil {
+		return err
+	}
+	rotated, err := tailer.rotated()
+	if err != nil || !rotated {
+		return err
+	}
+	// Read the old file once more, for what was written to it between the
+	// read above and the new file showing up, and carry on with the new one.
+	if err := tailer.readNew(); err != nil {
+		return err
+	}
+	if err := tailer.reopen(); err != nil {
+		return err
+	}
+	return tailer.readNew()
+}
@@ -0,0 +1,85 @@
+package caddy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFollowRotation follows a log renamed away, then truncated, with lines
+// written all along: every line counts, once.
+func TestFollowRotation(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	opts := Options{CacheDir: filepath.Join(dir, "cache")}
+	sources := []Source{{Path: logPath, Format: "caddy"}}
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.Local)
+	appendLines(t, logPath, start, 0, 10)
+
+	counted := make(chan int, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Follow(ctx, sources, opts, 10*time.Millisecond, func(agg *Aggregator) error {
+			select {
+			case <-counted:
+			default:
+			}
+			counted <- streams(agg.Result())
+			return nil
+		})
+		done <- err
+	}()
+
+	// waitFor waits for the followed streams to reach want, and for a few
+	// more polls that they stay there.
+	waitFor := func(step string, want int) {
+		t.Helper()
+		got := -1
+		for deadline := time.Now().Add(5 * time.Second); got != want; {
+			select {
+			case got = <-counted:
+			case <-time.After(time.Until(deadline)):
+				t.Fatalf("%s: %d streams, want %d", step, got, want)
+			}
+		}
+		time.Sleep(3 * pollInterval)
+		if got = <-counted; got != want {
+			t.Fatalf("%s: %d streams, then %d, want %d", step, want, got, want)
+		}
+	}
+	waitFor("start", 10)
+
+	// Renamed away, with lines written to the old file before the new one
+	appendLines(t, logPath, start, 10, 15)
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, logPath+".1", start, 15, 17)
+	appendLines(t, logPath, start, 17, 20)
+	waitFor("rename", 20)
+
+	// Copied and truncated in place
+	if err := os.Truncate(logPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, logPath, start, 20, 22)
+	waitFor("truncation", 22)
+	appendLines(t, logPath, start, 22, 25)
+	waitFor("after the truncation", 25)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	result, stats, err := IncrementalResult(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := streams(result); got != 25 || stats.Read != 0 {
+		t.Errorf("after following: %d streams and %d lines read, want 25 and none", got, stats.Read)
+	}
+}
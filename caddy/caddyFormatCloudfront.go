@@ -0,0 +1,129 @@
+package caddy
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudFrontDefaultFields is the column order of CloudFront standard logs,
+// used until the file declares its own with a "#Fields:" directive.
+var cloudFrontDefaultFields = []string{
+	"date", "time", "x-edge-location", "sc-bytes", "c-ip", "cs-method",
+	"cs(Host)", "cs-uri-stem", "sc-status", "cs(Referer)", "cs(User-Agent)",
+	"cs-uri-query", "cs(Cookie)", "x-edge-result-type", "x-edge-request-id",
+	"x-host-header", "cs-protocol", "cs-bytes", "time-taken",
+	"x-forwarded-for",
+}
+
+// cloudFrontFormat reads the tab separated W3C logs that CloudFront
+// delivers to S3.
+type cloudFrontFormat struct {
+	columns map[string]int
+}
+
+func newCloudFrontFormat() *cloudFrontFormat {
+	f := &cloudFrontFormat{}
+	f.setFields(cloudFrontDefaultFields)
+	return f
+}
+
+func (f *cloudFrontFormat) setFields(fields []string) {
+	f.columns = make(map[string]int, len(fields))
+	for i, field := range fields {
+		f.columns[field] = i
+	}
+}
+
+// field returns the named column, or "" when it is absent or "-".
+func (f *cloudFrontFormat) field(values []string, name string) string {
+	i, ok := f.columns[name]
+	if !ok || i >= len(values) || values[i] == "-" {
+		return ""
+	}
+	return values[i]
+}
+
+func (f *cloudFrontFormat) Parse(line []byte) (LogData, error) {
+	if bytes.HasPrefix(line, []byte("#")) {
+		if fields, ok := bytes.CutPrefix(line, []byte("#Fields:")); ok {
+			f.setFields(strings.Fields(string(fields)))
+		}
+		return LogData{}, errSkipLine
+	}
+
+	values := strings.Split(string(line), "\t")
+	if len(values) < len(f.columns) {
+		return LogData{}, fmt.Errorf("expected %d tab separated fields, found %d", len(f.columns), len(values))
+	}
+
+	logged, err := time.Parse("2006-01-02 15:04:05", f.field(values, "date")+" "+f.field(values, "time"))
+	if err != nil {
+		return LogData{}, err
+	}
+
+	size, err := strconv.ParseInt(f.field(values, "sc-bytes"), 10, 64)
+	if err != nil {
+		return LogData{}, fmt.Errorf("invalid sc-bytes: %w", err)
+	}
+
+	status, _ := strconv.Atoi(f.field(values, "sc-status"))
+
+	uri := f.field(values, "cs-uri-stem")
+	if decoded, err := url.PathUnescape(uri); err == nil {
+		uri = decoded
+	}
+	if query := f.field(values, "cs-uri-query"); query != "" {
+		uri += "?" + query
+	}
+
+	// CloudFront URL-encodes the User-Agent, sometimes twice.
+	userAgent := f.field(values, "cs(User-Agent)")
+	for i := 0; i < 2 && strings.Contains(userAgent, "%"); i++ {
+		decoded, err := url.PathUnescape(userAgent)
+		if err != nil {
+			break
+		}
+		userAgent = decoded
+	}
+
+	// The host the viewer asked for, rather than the distribution domain
+	host := f.field(values, "x-host-header")
+	if host == "" {
+		host = f.field(values, "cs(Host)")
+	}
+	var duration time.Duration
+	if seconds, err := strconv.ParseFloat(f.field(values, "time-taken"), 64); err == nil {
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+
+	// Newer CloudFront logs carry the served range as separate columns
+	var contentRange string
+	if start, end := f.field(values, "sc-range-start"), f.field(values, "sc-range-end"); start != "" && end != "" {
+		contentRange = "bytes " + start + "-" + end + "/" + f.field(values, "sc-content-len")
+		if f.field(values, "sc-content-len") == "" {
+			contentRange += "*"
+		}
+	}
+
+	return LogData{
+		Time:      logged,
+		Timestamp: logged.Local().Format("2006-01-02 15:04:05"),
+		URI:       uri,
+		UserAgent: userAgent,
+		Size:      size,
+		Method:    f.field(values, "cs-method"),
+		Status:    status,
+		Host:      host,
+		Referer:   refererDomain(f.field(values, "cs(Referer)")),
+		Duration:  duration,
+
+		RemoteIP:     f.field(values, "c-ip"),
+		ForwardedFor: f.field(values, "x-forwarded-for"),
+		ContentRange: contentRange,
+		ContentType:  f.field(values, "sc-content-type"),
+	}, nil
+}
@@ -0,0 +1,76 @@
+package caddy
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// combinedLine matches the nginx/Apache "combined" log format:
+//
+//	%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"
+//
+// nginx setups behind a proxy often append "$http_x_forwarded_for", which
+// is picked up as an optional trailing field.
+var combinedLine = regexp.MustCompile(
+	`^(\S+) \S+ \S+ \[([^\]]+)\] "([^"\\]*(?:\\.[^"\\]*)*)" (\d{3}) (\d+|-) "([^"\\]*(?:\\.[^"\\]*)*)" "([^"\\]*(?:\\.[^"\\]*)*)"(?: "([^"\\]*(?:\\.[^"\\]*)*)")?`)
+
+const combinedTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// combinedFormat reads nginx/Apache access logs in the combined format.
+type combinedFormat struct{}
+
+func (combinedFormat) Parse(line []byte) (LogData, error) {
+	m := combinedLine.FindStringSubmatch(string(line))
+	if m == nil {
+		return LogData{}, errors.New("line does not match the combined log format")
+	}
+
+	logged, err := time.Parse(combinedTimeLayout, m[2])
+	if err != nil {
+		return LogData{}, err
+	}
+
+	// The request line is "METHOD URI PROTOCOL"
+	method, uri := "", m[3]
+	if fields := strings.Fields(m[3]); len(fields) >= 2 {
+		method, uri = fields[0], fields[1]
+	}
+	if decoded, err := url.PathUnescape(uri); err == nil {
+		uri = decoded
+	}
+
+	status, _ := strconv.Atoi(m[4])
+
+	var size int64
+	if m[5] != "-" {
+		size, _ = strconv.ParseInt(m[5], 10, 64)
+	}
+
+	forwardedFor := m[8]
+	if forwardedFor == "-" {
+		forwardedFor = ""
+	}
+
+	userAgent := m[7]
+	if userAgent == "-" {
+		userAgent = ""
+	}
+
+	return LogData{
+		Time:      logged,
+		Timestamp: logged.Local().Format("2006-01-02 15:04:05"),
+		URI:       uri,
+		UserAgent: userAgent,
+		Size:      size,
+		Method:    method,
+		Status:    status,
+		Referer:   refererDomain(m[6]),
+
+		RemoteIP:     m[1],
+		ForwardedFor: forwardedFor,
+	}, nil
+}
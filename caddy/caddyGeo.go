@@ -0,0 +1,184 @@
+package caddy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ruvido/goSpotifyPodcastAnalytics/geoip"
+)
+
+// unknownGroup labels records without a value for the --by dimension.
+const unknownGroup = "unknown"
+
+// Breakdowns are the dimensions counts can be broken down by with --by.
+var Breakdowns = []string{"country", "region", "city", "app", "device", "os", "host", "show"}
+
+// CheckBreakdown returns an error when by is not one of Breakdowns.
+func CheckBreakdown(by string) error {
+	if by == "" {
+		return nil
+	}
+	for _, name := range Breakdowns {
+		if by == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot break down by %q (supported: %s)", by, strings.Join(Breakdowns, ", "))
+}
+
+func breakdownValue(entry LogData, by string) string {
+	var value string
+	switch by {
+	case "country":
+		value = entry.Country
+	case "region":
+		value = joinLocation(entry.Country, entry.Region)
+	case "city":
+		value = joinLocation(entry.Country, entry.Region, entry.City)
+	case "app":
+		value = entry.App
+	case "device":
+		value = entry.Device
+	case "os":
+		value = entry.OS
+	case "host":
+		value = entry.Host
+	case "show":
+		value = entry.Show
+	}
+	if value == "" {
+		return unknownGroup
+	}
+	return value
+}
+
+// joinLocation names a region or city together with what contains it, so
+// that places with the same name in different countries stay apart. It
+// is empty when the innermost part is unknown.
+func joinLocation(parts ...string) string {
+	if parts[len(parts)-1] == "" {
+		return ""
+	}
+	return strings.Join(parts, "/")
+}
+
+func incrementGroup(ts TimeSeries, group string, isStream bool) TimeSeries {
+	if ts.Breakdown == nil {
+		ts.Breakdown = make(map[string]Counts)
+	}
+	counts := ts.Breakdown[group]
+	if isStream {
+		counts.Streams++
+	} else {
+		counts.Listeners++
+	}
+	ts.Breakdown[group] = counts
+	return ts
+}
+
+// enrichLocation fills in the location of the record's client address.
+// Lookups that fail leave the location empty.
+func enrichLocation(entry *LogData, reader *geoip.Reader) {
+	location, err := reader.Lookup(entry.RealIP)
+	if err != nil {
+		return
+	}
+	entry.Country = location.Country
+	entry.Region = location.Region
+	entry.City = location.City
+}
+
+// GeoCount is the audience of one place over the whole period.
+type GeoCount struct {
+	Country   string  `json:"country"`
+	Region    string  `json:"region,omitempty"`
+	City      string  `json:"city,omitempty"`
+	Streams   int     `json:"streams"`
+	Listeners int     `json:"listeners"`
+	Share     float64 `json:"share"` // Percentage of all listeners
+}
+
+// GeographyReport is where listeners were over a period, at three levels
+// of detail, most listeners first.
+type GeographyReport struct {
+	Listeners int        `json:"listeners"`
+	Countries []GeoCount `json:"countries"`
+	Regions   []GeoCount `json:"regions"`
+	Cities    []GeoCount `json:"cities"`
+}
+
+// Geography counts distinct streams (per day, as in the time series) and
+// distinct listeners over the whole period per country, region and city.
+func Geography(data []LogData) GeographyReport {
+	type place struct{ country, region, city string }
+	type sets struct {
+		streams   map[string]struct{}
+		listeners map[string]struct{}
+	}
+
+	levels := make([]map[place]*sets, 3)
+	for i := range levels {
+		levels[i] = make(map[place]*sets)
+	}
+	allListeners := make(map[string]struct{})
+
+	for _, entry := range data {
+		if !countable(entry) {
+			continue
+		}
+		date := entry.Timestamp[:10]
+		streamKey := date + episodeKey(entry) + entry.RealIP + entry.UserAgent
+		listenerKey := entry.RealIP + entry.UserAgent
+		allListeners[listenerKey] = struct{}{}
+
+		country := entry.Country
+		if country == "" {
+			country = unknownGroup
+		}
+		places := []place{
+			{country, "", ""},
+			{country, entry.Region, ""},
+			{country, entry.Region, entry.City},
+		}
+		for i, p := range places {
+			if i > 0 && (p.region == "" || (i == 2 && p.city == "")) {
+				continue
+			}
+			s, ok := levels[i][p]
+			if !ok {
+				s = &sets{streams: make(map[string]struct{}), listeners: make(map[string]struct{})}
+				levels[i][p] = s
+			}
+			s.streams[streamKey] = struct{}{}
+			s.listeners[listenerKey] = struct{}{}
+		}
+	}
+
+	report := GeographyReport{Listeners: len(allListeners)}
+	lists := make([][]GeoCount, 3)
+	for i, level := range levels {
+		for p, s := range level {
+			count := GeoCount{
+				Country:   p.country,
+				Region:    p.region,
+				City:      p.city,
+				Streams:   len(s.streams),
+				Listeners: len(s.listeners),
+			}
+			if report.Listeners > 0 {
+				count.Share = 100 * float64(count.Listeners) / float64(report.Listeners)
+			}
+			lists[i] = append(lists[i], count)
+		}
+		sort.Slice(lists[i], func(a, b int) bool {
+			x, y := lists[i][a], lists[i][b]
+			if x.Listeners != y.Listeners {
+				return x.Listeners > y.Listeners
+			}
+			return x.Country+x.Region+x.City < y.Country+y.Region+y.City
+		})
+	}
+	report.Countries, report.Regions, report.Cities = lists[0], lists[1], lists[2]
+	return report
+}
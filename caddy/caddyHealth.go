@@ -0,0 +1,111 @@
+package caddy
+
+import (
+	"sort"
+	"time"
+)
+
+// HealthStats describes how audio delivery went over a day on one host,
+// or over the whole period.
+type HealthStats struct {
+	Date         string  `json:"date,omitempty"`
+	Host         string  `json:"host,omitempty"`
+	Requests     int     `json:"requests"`
+	ClientErrors int     `json:"clientErrors"` // 4xx responses
+	ServerErrors int     `json:"serverErrors"` // 5xx responses
+	ErrorRate    float64 `json:"errorRate"`    // Percentage of 4xx and 5xx responses
+	Timed        int     `json:"timed"`        // Requests that logged a duration
+
+	// Response time percentiles, in milliseconds
+	P50 float64 `json:"p50Ms"`
+	P95 float64 `json:"p95Ms"`
+	P99 float64 `json:"p99Ms"`
+	Max float64 `json:"maxMs"`
+
+	durations []time.Duration
+}
+
+func (s *HealthStats) add(entry LogData) {
+	s.Requests++
+	switch {
+	case entry.Status >= 500:
+		s.ServerErrors++
+	case entry.Status >= 400:
+		s.ClientErrors++
+	}
+	if entry.Duration > 0 {
+		s.durations = append(s.durations, entry.Duration)
+	}
+}
+
+func (s *HealthStats) finish() {
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.ClientErrors+s.ServerErrors) / float64(s.Requests) * 100
+	}
+	s.Timed = len(s.durations)
+	if s.Timed == 0 {
+		return
+	}
+	sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+	s.P50 = percentile(s.durations, 0.50)
+	s.P95 = percentile(s.durations, 0.95)
+	s.P99 = percentile(s.durations, 0.99)
+	s.Max = milliseconds(s.durations[len(s.durations)-1])
+}
+
+// percentile picks the nearest-rank percentile p of sorted durations.
+func percentile(sorted []time.Duration, p float64) float64 {
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return milliseconds(sorted[rank])
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// HealthReport is the error rate and latency of audio delivery.
+type HealthReport struct {
+	Total HealthStats   `json:"total"`
+	Days  []HealthStats `json:"days"` // Per day and host
+}
+
+// Health reports on the audio requests of data, whatever their outcome.
+// The records should be read with Options.AllResponses, so that responses
+// without a body (most errors) are not missing.
+func Health(data []LogData) HealthReport {
+	var report HealthReport
+	days := make(map[[2]string]*HealthStats)
+	for _, entry := range data {
+		if entry.Kind != kindAudio || entry.Method == "HEAD" {
+			continue
+		}
+		key := [2]string{entry.Timestamp[:10], entry.Host}
+		day, ok := days[key]
+		if !ok {
+			day = &HealthStats{Date: key[0], Host: key[1]}
+			days[key] = day
+		}
+		day.add(entry)
+		report.Total.add(entry)
+	}
+
+	report.Total.finish()
+	report.Days = make([]HealthStats, 0, len(days))
+	for _, day := range days {
+		day.finish()
+		report.Days = append(report.Days, *day)
+	}
+	sort.Slice(report.Days, func(i, j int) bool {
+		if report.Days[i].Date != report.Days[j].Date {
+			return report.Days[i].Date < report.Days[j].Date
+		}
+		return report.Days[i].Host < report.Days[j].Host
+	})
+	return report
+}
@@ -0,0 +1,101 @@
+package caddy
+
+import "time"
+
+// iabWindow is how long range requests from one client for one file are
+// combined into a single download.
+const iabWindow = 24 * time.Hour
+
+// IABOptions configures IAB Podcast Measurement style download counting.
+type IABOptions struct {
+	DefaultBitrate int // kbps, used for files the feed gives no size and duration for
+}
+
+// minBytes is the number of bytes that make up one minute of audio for the
+// file requested by entry: from the feed, or the default bitrate.
+func (o *IABOptions) minBytes(entry LogData) int64 {
+	if ep := entry.Episode; ep != nil && ep.Length > 0 && ep.Duration > 0 {
+		return int64(float64(ep.Length) / ep.Duration.Minutes())
+	}
+	return int64(o.DefaultBitrate) * 1000 / 8 * 60
+}
+
+// iabEligible reports whether a request can contribute to an IAB download:
+// a GET (or unlogged method) answered with a 2xx, from something the bot
+// rules did not tag. Bots only get this far with Options.IncludeBots.
+func iabEligible(entry LogData) bool {
+	if entry.Method != "" && entry.Method != "GET" {
+		return false
+	}
+	if entry.Status != 0 && (entry.Status < 200 || entry.Status > 299) {
+		return false
+	}
+	return entry.Bot == ""
+}
+
+// downloadWindow collects the requests of one client for one file over a
+// rolling 24 hours.
+type downloadWindow struct {
+	Start    float64 `json:"start"` // Unix time of the first request
+	Date     string  `json:"date"`  // Day the download is attributed to
+	Category string  `json:"category"`
+	Bytes    int64   `json:"bytes"`
+	Counted  bool    `json:"counted"`
+}
+
+// addIAB feeds one request into the download windows, counting a download
+// on the day its window opened once a minute of audio has been served.
+func (a *Aggregator) addIAB(entry LogData, date, category string) {
+	if !iabEligible(entry) {
+		return
+	}
+
+	now := float64(entry.Time.UnixNano()) / 1e9
+	key := episodeKey(entry) + entry.RealIP + entry.UserAgent
+	window, ok := a.Windows[key]
+	if !ok || now-window.Start >= iabWindow.Seconds() {
+		window = &downloadWindow{Start: now, Date: date, Category: category}
+		a.Windows[key] = window
+	}
+
+	window.Bytes += entry.Size
+	if !window.Counted && window.Bytes >= a.iab.minBytes(entry) {
+		window.Counted = true
+		day := a.day(window.Date)
+		day.Downloads[window.Category]++
+	}
+
+	a.expireWindows(now)
+}
+
+// expireWindows drops the windows that can no longer grow, so that the
+// persisted state stays small. It only scans once the clock has moved on
+// by a whole window since the last sweep.
+func (a *Aggregator) expireWindows(now float64) {
+	if now-a.LastSweep < iabWindow.Seconds() {
+		return
+	}
+	for key, window := range a.Windows {
+		if now-window.Start >= iabWindow.Seconds() {
+			delete(a.Windows, key)
+		}
+	}
+	a.LastSweep = now
+}
+
+func addDownloads(ts TimeSeries, category string, n int) TimeSeries {
+	ts.All.Downloads += n
+	switch category {
+	case "web":
+		ts.Web.Downloads += n
+	case "spotify":
+		ts.Spotify.Downloads += n
+	case "other":
+		ts.Other.Downloads += n
+	default:
+		counts := ts.category(category)
+		counts.Downloads += n
+		ts.Categories[category] = counts
+	}
+	return ts
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package caddy
+
+import (
+	"os"
+)
+
+// fileInode is not available on this platform: rotation is then detected
+// from the file size and fingerprint alone.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package caddy
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of an open file, used to notice when
+// the log path has been rotated to a new file.
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+package caddy
+
+import (
+	"mime"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Kinds of request, by what was served.
+const (
+	kindAudio = "audio" // Episode files: the only requests counted as streams
+	kindFeed  = "feed"  // RSS and Atom feeds
+	kindPage  = "page"  // HTML pages, reported as page views
+	kindAsset = "asset" // Images, styles, scripts, fonts and the rest
+)
+
+// audioExtensions are the file types served as podcast audio.
+var audioExtensions = map[string]bool{
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".oga": true,
+	".opus": true, ".wav": true, ".flac": true, ".mp4": true,
+}
+
+var feedExtensions = map[string]bool{".xml": true, ".rss": true, ".atom": true}
+
+var pageExtensions = map[string]bool{
+	".html": true, ".htm": true, ".php": true, ".asp": true, ".aspx": true,
+}
+
+// requestKind classifies a request as audio, feed, page or asset. A feed
+// match makes it audio; otherwise the file extension decides, then the
+// logged Content-Type. Paths without an extension are pages, unless they
+// name a feed (/feed, /rss, /podcast.rss...).
+func requestKind(entry LogData) string {
+	if entry.Episode != nil {
+		return kindAudio
+	}
+
+	uri, _, _ := strings.Cut(entry.URI, "?")
+	ext := strings.ToLower(path.Ext(uri))
+	switch {
+	case audioExtensions[ext]:
+		return kindAudio
+	case feedExtensions[ext]:
+		return kindFeed
+	case pageExtensions[ext]:
+		return kindPage
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(entry.ContentType); err == nil {
+		switch {
+		case strings.HasPrefix(mediaType, "audio/"):
+			return kindAudio
+		case strings.Contains(mediaType, "rss") || strings.Contains(mediaType, "atom") ||
+			mediaType == "application/xml" || mediaType == "text/xml":
+			return kindFeed
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			return kindPage
+		}
+		return kindAsset
+	}
+
+	if ext != "" {
+		return kindAsset
+	}
+	for _, segment := range strings.Split(strings.ToLower(uri), "/") {
+		if segment == "feed" || segment == "rss" || segment == "atom" {
+			return kindFeed
+		}
+	}
+	return kindPage
+}
+
+// pageView reports whether a request is a view of a web page: a page
+// served in full to a GET, or to a request that does not log its method.
+func pageView(entry LogData) bool {
+	if entry.Kind != kindPage || entry.Size <= 0 {
+		return false
+	}
+	if entry.Method != "" && entry.Method != "GET" {
+		return false
+	}
+	return entry.Status == 0 || (entry.Status >= 200 && entry.Status <= 299)
+}
+
+// PageCounts are the views of the web pages and their distinct visitors.
+type PageCounts struct {
+	Views    int `json:"views"`
+	Visitors int `json:"visitors"`
+}
+
+// PageReport is the audience of one web page.
+type PageReport struct {
+	Path     string `json:"path"`            // Host and path, without the query string
+	Title    string `json:"title,omitempty"` // Episode title, when the feed links to the page
+	Views    int    `json:"views"`
+	Visitors int    `json:"visitors"` // Distinct over the period
+}
+
+// Pages counts the views and distinct visitors of every web page, most
+// viewed first.
+func Pages(data []LogData) []PageReport {
+	type page struct {
+		report   *PageReport
+		visitors map[string]struct{}
+	}
+
+	pages := make(map[string]*page)
+	for _, entry := range data {
+		if !pageView(entry) {
+			continue
+		}
+		uri, _, _ := strings.Cut(entry.URI, "?")
+		if trimmed := strings.TrimRight(uri, "/"); trimmed != "" {
+			uri = trimmed
+		}
+		key := entry.Host + uri
+		p, ok := pages[key]
+		if !ok {
+			p = &page{report: &PageReport{Path: key}, visitors: make(map[string]struct{})}
+			if entry.Episode != nil {
+				p.report.Title = entry.Episode.Title
+			}
+			pages[key] = p
+		}
+		p.report.Views++
+		p.visitors[entry.RealIP+entry.UserAgent] = struct{}{}
+	}
+
+	report := make([]PageReport, 0, len(pages))
+	for _, p := range pages {
+		p.report.Visitors = len(p.visitors)
+		report = append(report, *p.report)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Views != report[j].Views {
+			return report[i].Views > report[j].Views
+		}
+		return report[i].Path < report[j].Path
+	})
+	return report
+}
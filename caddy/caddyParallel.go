@@ -0,0 +1,306 @@
+package caddy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// minChunkSize is the smallest share of a log handed to one worker: below
+// it, splitting costs more than it saves.
+const minChunkSize = 8 << 20
+
+// chunk is a range of a log file holding whole lines.
+type chunk struct {
+	start, end int64
+}
+
+// chunkParse is what a worker made of one chunk.
+type chunkParse struct {
+	parser  *lineParser // Statistics and quarantined lines of the chunk
+	entries []LogData   // Admitted records, in log order
+	agg     *Aggregator // Admitted records, already counted
+	lastTs  float64     // Newest timestamp decoded
+	err     error
+}
+
+// workers is how many goroutines decode a log.
+func (opts Options) workers() int {
+	if opts.Workers > 0 {
+		return opts.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// parallel reports whether source can be decoded by several workers.
+func (opts Options) parallel(source Source) bool {
+	return opts.workers() > 1 && statelessFormats[source.Format]
+}
+
+// splitChunks cuts the bytes of file from start to end into ranges of at
+// least minChunkSize, a few per worker so that a slow one does not hold
+// the others up. Ranges begin on a line; all but the last end on one.
+func splitChunks(file *os.File, start, end int64, workers int) ([]chunk, error) {
+	count := (end - start) / minChunkSize
+	count = min(count, int64(4*workers))
+	count = max(count, 1)
+	size := (end - start) / count
+
+	var chunks []chunk
+	from := start
+	for i := int64(1); i < count; i++ {
+		to, err := nextLine(file, start+i*size, end)
+		if err != nil {
+			return nil, err
+		}
+		if to <= from {
+			// A line longer than a chunk
+			continue
+		}
+		chunks = append(chunks, chunk{start: from, end: to})
+		from = to
+	}
+	if from < end {
+		chunks = append(chunks, chunk{start: from, end: end})
+	}
+	return chunks, nil
+}
+
+// nextLine returns the offset just past the first newline at or after
+// offset, or end when there is none before it.
+func nextLine(file *os.File, offset, end int64) (int64, error) {
+	buf := make([]byte, 64<<10)
+	for offset < end {
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), end-offset)], offset)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return offset + int64(i) + 1, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("failed to read file: %w", err)
+		}
+		if n == 0 {
+			break
+		}
+		offset += int64(n)
+	}
+	return end, nil
+}
+
+// lastLine returns the offset just past the last newline between start
+// and end, or start when there is none.
+func lastLine(file *os.File, start, end int64) (int64, error) {
+	buf := make([]byte, 64<<10)
+	for end > start {
+		from := max(start, end-int64(len(buf)))
+		part := buf[:end-from]
+		if _, err := io.ReadFull(io.NewSectionReader(file, from, end-from), part); err != nil {
+			return 0, fmt.Errorf("failed to read file: %w", err)
+		}
+		if i := bytes.LastIndexByte(part, '\n'); i >= 0 {
+			return from + int64(i) + 1, nil
+		}
+		end = from
+	}
+	return start, nil
+}
+
+// decodeChunk hands every record decoded from c to visit. The chunk gets
+// a parser of its own, which holds quarantined lines back (see
+// lineParser.absorb) and numbers lines from the start of the chunk.
+func decodeChunk(file *os.File, c chunk, source Source, opts Options, visit func(LogData)) (*lineParser, error) {
+	parser, err := newLineParser(source, opts)
+	if err != nil {
+		return nil, err
+	}
+	parser.hold = true
+
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, c.start, c.end-c.start), 1<<16)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return parser, fmt.Errorf("failed to read line: %w", err)
+		}
+		if len(line) > 0 {
+			entry, ok, perr := parser.parse(line)
+			if perr != nil {
+				return parser, perr
+			}
+			if ok {
+				visit(entry)
+			}
+		}
+		if err == io.EOF {
+			return parser, nil
+		}
+	}
+}
+
+// parseChunks runs parse on the chunks with the given number of workers
+// and hands the results to consume one at a time, in chunk order, so that
+// merging them gives exactly what reading the log serially would have. A
+// few chunks are parsed ahead of the one being consumed, no more, to keep
+// memory bounded on large logs.
+func parseChunks(chunks []chunk, workers int, parse func(chunk) *chunkParse, consume func(*chunkParse) error) error {
+	results := make([]chan *chunkParse, len(chunks))
+	for i := range results {
+		results[i] = make(chan *chunkParse, 1)
+	}
+	ahead := make(chan struct{}, 2*workers)
+	running := make(chan struct{}, workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i, c := range chunks {
+			select {
+			case ahead <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int, c chunk) {
+				running <- struct{}{}
+				result := parse(c)
+				<-running
+				results[i] <- result
+			}(i, c)
+		}
+	}()
+
+	for i := range chunks {
+		result := <-results[i]
+		<-ahead
+		if err := consume(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLogDataParallel is ReadLogData for large logs: the file is decoded
+// and admitted by several workers, and the records put back in log order.
+func readLogDataParallel(source Source, opts Options, parser *lineParser) ([]LogData, error) {
+	file, err := os.Open(source.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	chunks, err := splitChunks(file, 0, info.Size(), opts.workers())
+	if err != nil {
+		return nil, err
+	}
+
+	var logDataList []LogData
+	parse := func(c chunk) *chunkParse {
+		result := &chunkParse{}
+		result.parser, result.err = decodeChunk(file, c, source, opts, func(entry LogData) {
+			if opts.admit(&entry) {
+				result.entries = append(result.entries, entry)
+			}
+		})
+		return result
+	}
+	consume := func(result *chunkParse) error {
+		if result.parser != nil {
+			if err := parser.absorb(result.parser); err != nil {
+				return err
+			}
+		}
+		if result.err != nil {
+			return result.err
+		}
+		logDataList = append(logDataList, result.entries...)
+		return nil
+	}
+	if err := parseChunks(chunks, opts.workers(), parse, consume); err != nil {
+		return nil, err
+	}
+	return logDataList, nil
+}
+
+// readParallel consumes the complete lines appended since the last read
+// with several workers, when there are enough of them to be worth it; the
+// rest is left to readNew. Each worker counts its chunk in an aggregator of
+// its own, and these are merged in log order, which keeps for every key
+// the classification of its first request as the serial path does. IAB
+// download windows span chunks, so with IAB the workers only decode and
+// the records are counted here, in order.
+func (t *logTailer) readParallel() error {
+	if len(t.pending) > 0 || !t.opts.parallel(t.source) {
+		return nil
+	}
+	info, err := t.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if info.Size()-t.offset < 2*minChunkSize {
+		return nil
+	}
+	end, err := lastLine(t.file, t.offset, info.Size())
+	if err != nil {
+		return err
+	}
+	chunks, err := splitChunks(t.file, t.offset, end, t.opts.workers())
+	if err != nil {
+		return err
+	}
+
+	iab := t.state.Aggregator.iab != nil
+	parse := func(c chunk) *chunkParse {
+		result := &chunkParse{}
+		if !iab {
+			result.agg = NewAggregator()
+			result.agg.configure(t.opts)
+		}
+		result.parser, result.err = decodeChunk(t.file, c, t.source, t.opts, func(entry LogData) {
+			ts := float64(entry.Time.UnixNano()) / 1e9
+			if ts < t.minTs {
+				return
+			}
+			result.lastTs = max(result.lastTs, ts)
+			if !t.opts.admit(&entry) || !t.opts.Filter.Match(&entry) {
+				return
+			}
+			if result.agg != nil {
+				result.agg.Add(entry)
+			} else {
+				result.entries = append(result.entries, entry)
+			}
+		})
+		return result
+	}
+	consume := func(result *chunkParse) error {
+		if result.parser != nil {
+			if err := t.parser.absorb(result.parser); err != nil {
+				return err
+			}
+		}
+		if result.err != nil {
+			return result.err
+		}
+		t.state.Checkpoint.LastTs = max(t.state.Checkpoint.LastTs, result.lastTs)
+		if result.agg != nil {
+			t.state.Aggregator.Merge(result.agg)
+		}
+		for _, entry := range result.entries {
+			t.state.Aggregator.Add(entry)
+		}
+		return nil
+	}
+	if err := parseChunks(chunks, t.opts.workers(), parse, consume); err != nil {
+		return err
+	}
+
+	t.offset = end
+	if _, err := t.file.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek file: %w", err)
+	}
+	return nil
+}
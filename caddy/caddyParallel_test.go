@@ -0,0 +1,180 @@
+package caddy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// benchLines is the size of the synthetic log, a busy month of a popular
+// show. It takes a few GB of disk; run with -benchtime=1x.
+const benchLines = 10_000_000
+
+var benchAgents = []string{
+	"Spotify/8.9.2 Android/33 (SM-G991B)",
+	"AppleCoreMedia/1.0.0.21E236 (iPhone; U; CPU OS 17_4 like Mac OS X; en_us)",
+	"Overcast/3.0 (+http://overcast.fm/; iOS podcast app)",
+	"PocketCasts/1.0 (Pocket Casts Feed Parser; +http://pocketcasts.com/)",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36",
+	"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+	"curl/8.4.0",
+}
+
+// writeBenchLog writes a Caddy log of n requests spread over 30 days, with
+// range requests, HEADs, errors and the odd truncated line.
+func writeBenchLog(path string, n int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(file, 1<<20)
+	start := 1717200000.0
+	for i := 0; i < n; i++ {
+		method, status, size := "GET", 200, 48_000_000
+		switch {
+		case i%97 == 0:
+			fmt.Fprintln(writer, `{"ts": 1717200000, "request": {"remote_ip": "10.`)
+			continue
+		case i%31 == 0:
+			method, size = "HEAD", 0
+		case i%17 == 0:
+			status, size = 206, 1_000_000+i%5_000_000
+		case i%53 == 0:
+			status, size = 404, 120
+		}
+		client := (i * 7919) % 50_000
+		fmt.Fprintf(writer, `{"level":"info","ts":%.3f,"logger":"http.log.access","msg":"handled request",`+
+			`"request":{"remote_ip":"81.%d.%d.7","proto":"HTTP/2.0","method":"%s","host":"pod.example.com",`+
+			`"uri":"/episodes/e%03d.mp3","headers":{"User-Agent":["%s"]}},"duration":0.0%d,"size":%d,"status":%d}`+"\n",
+			start+float64(i)*(30*86400)/float64(n), client/256, client%256, method, i%120,
+			benchAgents[client%len(benchAgents)], 1+i%9, size, status)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// BenchmarkIncrementalAggregate digests the synthetic log from scratch with
+// one worker and with one per CPU, and checks that both count the same.
+func BenchmarkIncrementalAggregate(b *testing.B) {
+	dir := b.TempDir()
+	source := Source{Path: filepath.Join(dir, "access.log"), Format: "caddy"}
+	if err := writeBenchLog(source.Path, benchLines); err != nil {
+		b.Fatal(err)
+	}
+
+	results := make(map[int]Result)
+	for _, workers := range []int{1, max(runtime.NumCPU(), 2)} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			opts := Options{Workers: workers, QuarantinePath: filepath.Join(dir, "quarantine.log")}
+			for i := 0; i < b.N; i++ {
+				opts.CacheDir = filepath.Join(dir, fmt.Sprintf("cache-%d-%d", workers, i))
+				agg, stats, err := IncrementalAggregate([]Source{source}, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if stats.Read != benchLines {
+					b.Fatalf("read %d lines, want %d", stats.Read, benchLines)
+				}
+				results[workers] = agg.Result()
+			}
+		})
+	}
+
+	var first Result
+	for _, result := range results {
+		if first.TimeSeries == nil {
+			first = result
+			continue
+		}
+		if !reflect.DeepEqual(first, result) {
+			want, _ := json.Marshal(first)
+			got, _ := json.Marshal(result)
+			b.Fatalf("parallel result differs from serial:\n%s\n%s", want, got)
+		}
+	}
+}
+
+// TestParallelMatchesSerial decodes a log just big enough to be split
+// between workers, with one worker and with four: both must admit the same
+// records, count the same and quarantine the same lines.
+func TestParallelMatchesSerial(t *testing.T) {
+	dir := t.TempDir()
+	source := Source{Path: filepath.Join(dir, "access.log"), Format: "caddy"}
+	if err := writeBenchLog(source.Path, 50_000); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(source.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() <= 2*minChunkSize || info.Size() > 3*minChunkSize {
+		t.Fatalf("test log of %d bytes, want just over %d", info.Size(), 2*minChunkSize)
+	}
+
+	type run struct {
+		data       []LogData
+		stats      ParseStats
+		result     Result
+		aggStats   ParseStats
+		quarantine string
+	}
+	decode := func(workers int, iab bool) run {
+		name := fmt.Sprintf("%d-%t", workers, iab)
+		opts := Options{Workers: workers, CacheDir: filepath.Join(dir, "cache-"+name)}
+		if iab {
+			opts.IAB = &IABOptions{DefaultBitrate: 128}
+		}
+
+		var r run
+		opts.QuarantinePath = filepath.Join(dir, "quarantine-read-"+name+".log")
+		r.data, r.stats, err = ReadLogData(source, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.QuarantinePath = filepath.Join(dir, "quarantine-aggregate-"+name+".log")
+		agg, aggStats, err := IncrementalAggregate([]Source{source}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.result, r.aggStats = agg.Result(), aggStats
+
+		for _, path := range []string{"read", "aggregate"} {
+			content, err := os.ReadFile(filepath.Join(dir, "quarantine-"+path+"-"+name+".log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.quarantine += string(content)
+		}
+		return r
+	}
+
+	for _, iab := range []bool{false, true} {
+		serial, parallel := decode(1, iab), decode(4, iab)
+		if serial.stats.Quarantined == 0 || serial.quarantine == "" {
+			t.Fatalf("iab=%t: nothing quarantined, the test log should have broken lines", iab)
+		}
+		if serial.stats != parallel.stats || serial.aggStats != parallel.aggStats {
+			t.Errorf("iab=%t: parallel stats %v and %v, serial %v and %v",
+				iab, parallel.stats, parallel.aggStats, serial.stats, serial.aggStats)
+		}
+		if !reflect.DeepEqual(serial.data, parallel.data) {
+			t.Errorf("iab=%t: parallel read %d records, serial %d, or not the same", iab, len(parallel.data), len(serial.data))
+		}
+		if !reflect.DeepEqual(serial.result, parallel.result) {
+			want, _ := json.Marshal(serial.result)
+			got, _ := json.Marshal(parallel.result)
+			t.Errorf("iab=%t: parallel result differs from serial:\n%s\n%s", iab, want, got)
+		}
+		if serial.quarantine != parallel.quarantine {
+			t.Errorf("iab=%t: parallel quarantined other lines than serial", iab)
+		}
+	}
+}
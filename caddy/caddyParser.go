@@ -0,0 +1,225 @@
+package caddy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ruvido/goSpotifyPodcastAnalytics/geoip"
+	"github.com/ruvido/goSpotifyPodcastAnalytics/query"
+	"github.com/ruvido/goSpotifyPodcastAnalytics/rss"
+)
+
+// Options controls how access logs are read and digested.
+type Options struct {
+	Filter         *query.Query    // Which requests to count; nil for all
+	CacheDir       string          // Where checkpoints and aggregates are persisted
+	QuarantinePath string          // File collecting unparseable lines; empty to discard them
+	IAB            *IABOptions     // Count IAB downloads too; nil to skip
+	Bots           *BotFilter      // Rules recognizing bot traffic; nil to skip
+	IncludeBots    bool            // Count bot traffic anyway, only tagging it
+	Apps           *AppDatabase    // Podcast app user agents; nil to skip
+	Classifier     *Classifier     // User-agent category rules; nil for the built-in ones
+	GeoIP          *geoip.Reader   // Location database; nil to skip
+	By             string          // Dimension to break counts down by (see Breakdowns)
+	Anonymizer     *Anonymizer     // Replaces client addresses with pseudonyms; nil keeps them
+	Feed           *rss.Feed       // Podcast feed mapping URIs to episodes; nil to count URIs
+	Proxies        *TrustedProxies // Proxies whose forwarding headers are believed; nil for none
+	AllResponses   bool            // Admit responses without any bytes served too (see Health)
+	Shows          *ShowRouter     // Routes requests to shows; nil for a single show
+	Workers        int             // Goroutines decoding a log; 0 for one per CPU
+	Hourly         bool            // Keep hourly counts next to the daily ones, for Rollup by hour
+	ArchiveDir     string          // Where collect archives the lines it receives; empty for none
+	ArchiveKeep    int             // Days of archive kept; 0 keeps them all
+}
+
+// admit decides whether a decoded record takes part in counting. The
+// client address is resolved first. Records without any bytes served are
+// dropped (unless opts.AllResponses is set); bot traffic, recognized by the
+// bot rules or flagged in the app database, is tagged and, unless
+// opts.IncludeBots is set, dropped as well. Admitted records are
+// tagged with their show, episode, kind, podcast app, user-agent category and
+// location, and only then is their address anonymized: nothing past admit
+// sees a raw IP.
+func (opts Options) admit(entry *LogData) bool {
+	entry.RealIP = opts.Proxies.ClientIP(*entry)
+	if entry.Size <= 0 && !opts.AllResponses {
+		return false
+	}
+	if opts.Bots != nil {
+		entry.Bot, _ = opts.Bots.Match(*entry)
+	}
+	if entry.Bot == "" && opts.Apps != nil {
+		entry.Bot, _ = opts.Apps.Bot(entry.UserAgent)
+	}
+	if entry.Bot != "" && !opts.IncludeBots {
+		return false
+	}
+	if opts.Shows != nil {
+		entry.Show = opts.Shows.Route(*entry)
+	}
+	if opts.Feed != nil {
+		entry.Episode, _ = opts.Feed.Match(entry.URI)
+	}
+	entry.Kind = requestKind(*entry)
+	if entry.Kind == kindPage && opts.Feed != nil {
+		entry.Episode, _ = opts.Feed.MatchPage(entry.URI)
+	}
+	if opts.Apps != nil {
+		opts.Apps.Identify(entry)
+	}
+	if opts.Classifier != nil {
+		entry.Category = opts.Classifier.Classify(entry.UserAgent)
+	}
+	if opts.GeoIP != nil {
+		enrichLocation(entry, opts.GeoIP)
+	}
+	if opts.Anonymizer != nil {
+		opts.Anonymizer.Anonymize(entry)
+	}
+	return true
+}
+
+// ParseStats summarizes what happened to the lines of a log.
+type ParseStats struct {
+	Read        int `json:"read"`        // Lines read from the log
+	Parsed      int `json:"parsed"`      // Lines decoded into a log entry
+	Skipped     int `json:"skipped"`     // Blank lines and format directives
+	Quarantined int `json:"quarantined"` // Lines that could not be decoded
+	ZeroSize    int `json:"zeroSize"`    // Decoded entries with no bytes served
+}
+
+func (s ParseStats) String() string {
+	return fmt.Sprintf("read %d lines: %d parsed, %d skipped, %d quarantined, %d zero-size",
+		s.Read, s.Parsed, s.Skipped, s.Quarantined, s.ZeroSize)
+}
+
+// Add sums two sets of statistics.
+func (s ParseStats) Add(other ParseStats) ParseStats {
+	s.Read += other.Read
+	s.Parsed += other.Parsed
+	s.Skipped += other.Skipped
+	s.Quarantined += other.Quarantined
+	s.ZeroSize += other.ZeroSize
+	return s
+}
+
+// lineParser decodes raw log lines one at a time, keeping count of what it
+// saw and setting aside the lines it could not make sense of.
+type lineParser struct {
+	source         string
+	format         Format
+	line           int64
+	quarantinePath string
+	quarantine     *os.File
+	redact         bool // Leave the raw line out of the quarantine file
+	hold           bool // Keep quarantined lines in held instead of writing them
+	held           []heldLine
+	Stats          ParseStats
+}
+
+// heldLine is a quarantined line waiting to be written.
+type heldLine struct {
+	line  int64
+	cause error
+	text  []byte
+}
+
+// newLineParser reads source into opts.QuarantinePath. When addresses are
+// anonymized, quarantined lines are recorded without their content, since
+// it holds the client IP.
+func newLineParser(source Source, opts Options) (*lineParser, error) {
+	format, err := newFormat(source.Format)
+	if err != nil {
+		return nil, err
+	}
+	return &lineParser{
+		source:         source.Path,
+		format:         format,
+		quarantinePath: opts.QuarantinePath,
+		redact:         opts.Anonymizer != nil,
+	}, nil
+}
+
+// parse decodes one line. ok is false when the line was skipped or
+// quarantined; err is only set when the quarantine file cannot be written.
+func (p *lineParser) parse(raw []byte) (entry LogData, ok bool, err error) {
+	p.line++
+	p.Stats.Read++
+
+	line := bytes.TrimSpace(raw)
+	if len(line) == 0 {
+		p.Stats.Skipped++
+		return entry, false, nil
+	}
+
+	entry, err = p.format.Parse(line)
+	if err == errSkipLine {
+		p.Stats.Skipped++
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, p.quarantineLine(line, err)
+	}
+
+	p.Stats.Parsed++
+	if entry.Size <= 0 {
+		p.Stats.ZeroSize++
+	}
+	return entry, true, nil
+}
+
+func (p *lineParser) quarantineLine(line []byte, cause error) error {
+	p.Stats.Quarantined++
+	if p.quarantinePath == "" {
+		return nil
+	}
+	if p.hold {
+		p.held = append(p.held, heldLine{line: p.line, cause: cause, text: append([]byte(nil), line...)})
+		return nil
+	}
+	return p.writeQuarantine(p.line, cause, line)
+}
+
+func (p *lineParser) writeQuarantine(lineNumber int64, cause error, line []byte) error {
+	if p.quarantine == nil {
+		if err := os.MkdirAll(filepath.Dir(p.quarantinePath), 0o755); err != nil {
+			return fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+		file, err := os.OpenFile(p.quarantinePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open quarantine file: %w", err)
+		}
+		p.quarantine = file
+	}
+
+	if p.redact {
+		line = []byte("[redacted]")
+	}
+	_, err := fmt.Fprintf(p.quarantine, "%s:%d\t%v\t%s\n", p.source, lineNumber, cause, line)
+	if err != nil {
+		return fmt.Errorf("failed to write quarantine file: %w", err)
+	}
+	return nil
+}
+
+// absorb takes over what the parser of the next chunk of the log saw,
+// writing the lines it held back with their line numbers in the file.
+func (p *lineParser) absorb(chunk *lineParser) error {
+	for _, held := range chunk.held {
+		if err := p.writeQuarantine(p.line+held.line, held.cause, held.text); err != nil {
+			return err
+		}
+	}
+	p.line += chunk.line
+	p.Stats = p.Stats.Add(chunk.Stats)
+	return nil
+}
+
+func (p *lineParser) Close() error {
+	if p.quarantine == nil {
+		return nil
+	}
+	return p.quarantine.Close()
+}
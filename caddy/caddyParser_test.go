@@ -0,0 +1,51 @@
+package caddy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	quarantine := filepath.Join(t.TempDir(), "quarantine", "lines.log")
+	source := Source{Path: "/var/log/nginx/access.log", Format: "combined"}
+	parser, err := newLineParser(source, Options{QuarantinePath: quarantine})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{
+		`81.2.69.1 - - [03/Jun/2024:14:05:09 +0200] "GET /e1.mp3 HTTP/1.1" 200 4096 "-" "curl/8.4.0"`,
+		"",
+		`81.2.69.1 - - [03/Jun/2024:14:05:09 +0200] "GET /e1.mp3 HTTP/1.1" 200`,
+		`81.2.69.1 - - [03/Jun/2024:14:05:10 +0200] "HEAD /e1.mp3 HTTP/1.1" 200 - "-" "curl/8.4.0"`,
+	}
+	parsed := 0
+	for _, line := range lines {
+		_, ok, err := parser.parse([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			parsed++
+		}
+	}
+	if err := parser.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ParseStats{Read: 4, Parsed: 2, Skipped: 1, Quarantined: 1, ZeroSize: 1}
+	if parser.Stats != want || parsed != 2 {
+		t.Errorf("stats = %+v (%d parsed), want %+v", parser.Stats, parsed, want)
+	}
+
+	content, err := os.ReadFile(quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := strings.Split(strings.TrimSuffix(string(content), "\n"), "\t")
+	if len(record) != 3 || record[0] != source.Path+":3" || record[2] != lines[2] {
+		t.Errorf("quarantine = %q, want the source, line number, cause and line", content)
+	}
+}
@@ -0,0 +1,325 @@
+package caddy
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ruvido/goSpotifyPodcastAnalytics/data"
+)
+
+// Traffic sources of web plays.
+const (
+	sourceSite       = "site"       // A page of our own site, with no known way in
+	sourceSocial     = "social"     // Social networks and messaging apps
+	sourceNewsletter = "newsletter" // Webmail and newsletter platforms
+	sourceSearch     = "search"     // Search engines
+	sourceOther      = "other"      // Any other referring site
+	sourceDirect     = "direct"     // No referrer at all
+)
+
+// newsletterDomains are webmail clients and newsletter platforms. They are
+// checked first, so that mail.google.com is not taken for a search.
+var newsletterDomains = []string{
+	"mail.google.com", "outlook.live.com", "outlook.office.com", "outlook.office365.com",
+	"mail.yahoo.com", "mail.proton.me", "substack.com", "mailchi.mp", "list-manage.com",
+	"beehiiv.com", "buttondown.email", "convertkit.com", "ck.page", "sendibt3.com",
+	"mailerlite.com", "revue.email",
+}
+
+var socialDomains = []string{
+	"facebook.com", "fb.com", "fb.me", "instagram.com", "t.co", "twitter.com", "x.com",
+	"linkedin.com", "lnkd.in", "reddit.com", "youtube.com", "youtu.be", "tiktok.com",
+	"threads.net", "bsky.app", "mastodon.social", "pinterest.com", "whatsapp.com",
+	"telegram.org", "t.me", "discord.com", "tumblr.com",
+}
+
+// searchEngines are matched on any label but the last, to cover every
+// country domain (google.it, google.co.uk, search.brave.com...).
+var searchEngines = []string{
+	"google", "bing", "duckduckgo", "yahoo", "ecosia", "baidu", "yandex", "qwant",
+	"startpage", "brave", "kagi",
+}
+
+// refererDomain normalizes a Referer header to the host it names, in lower
+// case and without "www." or a port, so that only the referring site is
+// kept, not the page or its query string.
+func refererDomain(referer string) string {
+	referer = strings.TrimSpace(referer)
+	if referer == "" || referer == "-" {
+		return ""
+	}
+	if !strings.Contains(referer, "://") {
+		referer = "//" + referer
+	}
+	u, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimPrefix(host, "www.")
+}
+
+// hasDomain reports whether domain is one of domains or a subdomain of one.
+func hasDomain(domain string, domains []string) bool {
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSite reports whether one domain is the other or a subdomain of it,
+// as for a site and the CDN host serving its audio.
+func sameSite(a, b string) bool {
+	return a != "" && b != "" && (hasDomain(a, []string{b}) || hasDomain(b, []string{a}))
+}
+
+// classifyDomain returns the traffic source of a referring domain.
+func classifyDomain(domain string) string {
+	switch {
+	case domain == "":
+		return sourceDirect
+	case hasDomain(domain, newsletterDomains):
+		return sourceNewsletter
+	case hasDomain(domain, socialDomains):
+		return sourceSocial
+	}
+	labels := strings.Split(domain, ".")
+	for _, label := range labels[:len(labels)-1] {
+		for _, engine := range searchEngines {
+			if label == engine {
+				return sourceSearch
+			}
+		}
+	}
+	return sourceOther
+}
+
+// campaignSource reads the utm_medium and utm_source parameters of a
+// request URI, which newsletters and social posts add to their links
+// since mail clients send no referrer. The name is utm_source as given.
+func campaignSource(uri string) (source, name string) {
+	_, rawQuery, ok := strings.Cut(uri, "?")
+	if !ok {
+		return "", ""
+	}
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", ""
+	}
+	name = strings.ToLower(params.Get("utm_source"))
+	switch strings.ToLower(params.Get("utm_medium")) {
+	case "email", "e-mail", "newsletter":
+		return sourceNewsletter, name
+	case "social", "social-media", "social_media":
+		return sourceSocial, name
+	case "organic", "search", "cpc":
+		return sourceSearch, name
+	}
+	switch {
+	case name == "":
+		return "", ""
+	case strings.Contains(name, "newsletter") || strings.Contains(name, "mail"):
+		return sourceNewsletter, name
+	}
+	// A bare name, such as utm_source=facebook
+	if source := classifyDomain(name + ".com"); source != sourceOther {
+		return source, name
+	}
+	return sourceOther, name
+}
+
+// SourceCount is the web audience that came through one source or
+// referring domain.
+type SourceCount struct {
+	Source    string  `json:"source"`
+	Streams   int     `json:"streams"`
+	Listeners int     `json:"listeners"`
+	Share     float64 `json:"share"` // Percentage of all web streams
+}
+
+// SourcesDay is the web audience of one day per source.
+type SourcesDay struct {
+	Date    string            `json:"date"`
+	Sources map[string]Counts `json:"sources"`
+}
+
+// SourcesEpisode is the web audience of one episode per source.
+type SourcesEpisode struct {
+	Episode string            `json:"episode"` // Title, or URI path without a feed
+	Sources map[string]Counts `json:"sources"`
+}
+
+// SourcesReport is where web listeners came from over a period.
+type SourcesReport struct {
+	Streams  int              `json:"streams"`  // All web streams
+	Sources  []SourceCount    `json:"sources"`  // Per source, most streams first
+	Domains  []SourceCount    `json:"domains"`  // Per referring domain or campaign
+	Days     []SourcesDay     `json:"days"`     // Every day of the range, in order
+	Episodes []SourcesEpisode `json:"episodes"` // Most streams first
+}
+
+// TrafficSources attributes the web-classified plays of data to the
+// channel that brought the listener: the utm_ parameters of the request,
+// else its Referer. A play referred by our own site (siteDomains, and the
+// requested host) is attributed to the last page of the site the listener
+// opened from elsewhere that day, if the log has it, and to "site"
+// otherwise. Streams are counted per day as in the time series, by the
+// source of their first request; listeners are distinct over the period
+// within each source. Days has an entry for every day from startDate to
+// endDate, empty for the days without plays.
+func TrafficSources(records []LogData, siteDomains []string, startDate, endDate string) SourcesReport {
+	type sets struct {
+		streams   map[string]struct{}
+		listeners map[string]struct{}
+	}
+	type origin struct{ source, domain string }
+	add := func(groups map[string]*sets, group, streamKey, listenerKey string) {
+		s, ok := groups[group]
+		if !ok {
+			s = &sets{streams: make(map[string]struct{}), listeners: make(map[string]struct{})}
+			groups[group] = s
+		}
+		s.streams[streamKey] = struct{}{}
+		s.listeners[listenerKey] = struct{}{}
+	}
+
+	site := make([]string, 0, len(siteDomains))
+	for _, domain := range siteDomains {
+		if domain = refererDomain(domain); domain != "" {
+			site = append(site, domain)
+		}
+	}
+
+	landings := make(map[string]origin) // Listener and day to their way in
+	streams := make(map[string]origin)  // Stream to the source of its first request
+	sources := make(map[string]*sets)
+	domains := make(map[string]*sets)
+	days := make(map[string]map[string]*sets)
+	episodes := make(map[string]map[string]*sets)
+
+	for _, entry := range records {
+		category := entry.Category
+		if category == "" {
+			category = classifyUserAgent(entry.UserAgent)
+		}
+		if category != "web" {
+			continue
+		}
+
+		var o origin
+		o.source, o.domain = campaignSource(entry.URI)
+		if o.source == "" {
+			o.domain = entry.Referer
+			o.source = classifyDomain(o.domain)
+			if o.domain != "" && (hasDomain(o.domain, site) || sameSite(o.domain, refererDomain(entry.Host))) {
+				o.source = sourceSite
+			}
+		}
+
+		date := entry.Timestamp[:10]
+		listenerKey := entry.RealIP + entry.UserAgent
+		if entry.Kind == kindPage {
+			// A page view: remember how the listener got to the site
+			if o.source != sourceSite && o.source != sourceDirect && entry.Status < 400 {
+				landings[date+listenerKey] = o
+			}
+			continue
+		}
+		if !countable(entry) {
+			continue
+		}
+
+		if o.source == sourceSite {
+			if landing, ok := landings[date+listenerKey]; ok {
+				o = landing
+			}
+		}
+		streamKey := date + episodeKey(entry) + listenerKey
+		if first, seen := streams[streamKey]; seen {
+			o = first
+		} else {
+			streams[streamKey] = o
+		}
+
+		add(sources, o.source, streamKey, listenerKey)
+		if o.domain != "" && o.source != sourceSite {
+			add(domains, o.domain, streamKey, listenerKey)
+		}
+		if days[date] == nil {
+			days[date] = make(map[string]*sets)
+		}
+		add(days[date], o.source, streamKey, listenerKey)
+
+		episode := episodeKey(entry)
+		if entry.Episode != nil && entry.Episode.Title != "" {
+			episode = entry.Episode.Title
+		} else {
+			episode, _, _ = strings.Cut(episode, "?")
+		}
+		if episodes[episode] == nil {
+			episodes[episode] = make(map[string]*sets)
+		}
+		add(episodes[episode], o.source, streamKey, listenerKey)
+	}
+
+	report := SourcesReport{Streams: len(streams)}
+	counts := func(groups map[string]*sets) []SourceCount {
+		list := make([]SourceCount, 0, len(groups))
+		for group, s := range groups {
+			count := SourceCount{Source: group, Streams: len(s.streams), Listeners: len(s.listeners)}
+			if report.Streams > 0 {
+				count.Share = 100 * float64(count.Streams) / float64(report.Streams)
+			}
+			list = append(list, count)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Streams != list[j].Streams {
+				return list[i].Streams > list[j].Streams
+			}
+			return list[i].Source < list[j].Source
+		})
+		return list
+	}
+	byGroup := func(groups map[string]*sets) (map[string]Counts, int) {
+		result := make(map[string]Counts, len(groups))
+		total := 0
+		for group, s := range groups {
+			result[group] = Counts{Streams: len(s.streams), Listeners: len(s.listeners)}
+			total += len(s.streams)
+		}
+		return result, total
+	}
+
+	report.Sources = counts(sources)
+	report.Domains = counts(domains)
+
+	dates := data.Days(startDate, endDate)
+	report.Days = make([]SourcesDay, 0, len(dates))
+	for _, date := range dates {
+		day, _ := byGroup(days[date])
+		report.Days = append(report.Days, SourcesDay{Date: date, Sources: day})
+	}
+
+	totals := make(map[string]int, len(episodes))
+	report.Episodes = make([]SourcesEpisode, 0, len(episodes))
+	for episode, groups := range episodes {
+		bySource, total := byGroup(groups)
+		totals[episode] = total
+		report.Episodes = append(report.Episodes, SourcesEpisode{Episode: episode, Sources: bySource})
+	}
+	sort.Slice(report.Episodes, func(i, j int) bool {
+		a, b := report.Episodes[i].Episode, report.Episodes[j].Episode
+		if totals[a] != totals[b] {
+			return totals[a] > totals[b]
+		}
+		return a < b
+	})
+	return report
+}
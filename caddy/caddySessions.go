@@ -0,0 +1,252 @@
+package caddy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// completionBuckets are the ranges of the delivered fraction of a file.
+var completionBuckets = []string{"0-25%", "25-50%", "50-75%", "75-100%"}
+
+// Interval is a half-open byte range [Start, End) of a file.
+type Interval struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Session is what one listener fetched of one episode within 24 hours.
+type Session struct {
+	Episode   string     `json:"episode"`
+	Title     string     `json:"title,omitempty"` // From the feed, when configured
+	Listener  string     `json:"-"`
+	Start     time.Time  `json:"start"`
+	FileSize  int64      `json:"fileSize"`  // 0 when unknown
+	Intervals []Interval `json:"intervals"` // In the order they were served
+}
+
+// Delivered is the number of distinct bytes of the file that were served.
+func (s Session) Delivered() int64 {
+	intervals := make([]Interval, len(s.Intervals))
+	copy(intervals, s.Intervals)
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start < intervals[j].Start })
+
+	var delivered, reach int64
+	for _, iv := range intervals {
+		if iv.Start > reach {
+			reach = iv.Start
+		}
+		if iv.End > reach {
+			delivered += iv.End - reach
+			reach = iv.End
+		}
+	}
+	return delivered
+}
+
+// Fraction is the share of the file that was delivered, or -1 when the
+// file size is not known.
+func (s Session) Fraction() float64 {
+	if s.FileSize <= 0 {
+		return -1
+	}
+	fraction := float64(s.Delivered()) / float64(s.FileSize)
+	if fraction > 1 {
+		fraction = 1
+	}
+	return fraction
+}
+
+// parseByteRange reads the first range of a "bytes=a-b" Range header. A
+// suffix range ("bytes=-n") has no start until the file size is known, and
+// is reported with start -1 and end n.
+func parseByteRange(header string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found {
+		return 0, 0, false
+	}
+	spec, _, _ = strings.Cut(spec, ",")
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		return -1, n, err == nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end = -1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, end, true
+}
+
+// parseContentRange reads a "bytes a-b/total" Content-Range header; total
+// is 0 when the server wrote "*".
+func parseContentRange(header string) (start, end, total int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	span, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+
+	var err error
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, 0, false
+		}
+	}
+	return start, end + 1, total, true
+}
+
+// servedInterval works out which bytes of the file a request delivered,
+// and the file size when the response reveals it.
+func servedInterval(entry LogData, knownSize int64) (iv Interval, fileSize int64, ok bool) {
+	if start, end, total, found := parseContentRange(entry.ContentRange); found {
+		// A client that hangs up early receives less than announced
+		if entry.Size < end-start {
+			end = start + entry.Size
+		}
+		return Interval{start, end}, total, true
+	}
+
+	if entry.Status == 206 || (entry.Status == 0 && entry.Range != "") {
+		start, _, found := parseByteRange(entry.Range)
+		if !found {
+			return Interval{}, 0, false
+		}
+		if start < 0 {
+			// Suffix range: only placeable if we know where the file ends
+			if knownSize <= 0 {
+				return Interval{}, 0, false
+			}
+			start = knownSize - entry.Size
+		}
+		return Interval{start, start + entry.Size}, 0, true
+	}
+
+	// A plain 200 (also one that ignored the Range header) carries the
+	// whole file from the start
+	return Interval{0, entry.Size}, entry.ContentLength, true
+}
+
+// BuildSessions groups the audio requests of every listener (IP and
+// User-Agent) for every episode into 24-hour sessions and rebuilds the
+// byte intervals each one received. The feed enclosures supply file sizes
+// for files whose responses never reveal them.
+func BuildSessions(data []LogData) []Session {
+	sorted := make([]LogData, len(data))
+	copy(sorted, data)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	fileSizes := make(map[string]int64)
+
+	open := make(map[string]*Session)
+	var sessions []*Session
+	for _, entry := range sorted {
+		if entry.Kind != kindAudio || entry.Size <= 0 || (entry.Method != "" && entry.Method != "GET") {
+			continue
+		}
+		if entry.Status != 0 && entry.Status != 200 && entry.Status != 206 {
+			continue
+		}
+
+		episode, _, _ := strings.Cut(episodeKey(entry), "?")
+		title := ""
+		if ep := entry.Episode; ep != nil {
+			title = ep.Title
+			if fileSizes[episode] <= 0 {
+				fileSizes[episode] = ep.Length
+			}
+		}
+		iv, fileSize, ok := servedInterval(entry, fileSizes[episode])
+		if !ok {
+			continue
+		}
+		if fileSize > 0 && fileSizes[episode] <= 0 {
+			fileSizes[episode] = fileSize
+		}
+
+		listener := entry.RealIP + entry.UserAgent
+		key := episode + "\x00" + listener
+		session, found := open[key]
+		if !found || entry.Time.Sub(session.Start) >= iabWindow {
+			session = &Session{Episode: episode, Title: title, Listener: listener, Start: entry.Time}
+			open[key] = session
+			sessions = append(sessions, session)
+		}
+		session.Intervals = append(session.Intervals, iv)
+	}
+
+	result := make([]Session, 0, len(sessions))
+	for _, session := range sessions {
+		session.FileSize = fileSizes[session.Episode]
+		result = append(result, *session)
+	}
+	return result
+}
+
+// CompletionReport is the distribution of the delivered fraction of one
+// episode across its sessions.
+type CompletionReport struct {
+	Episode  string         `json:"episode"`
+	Title    string         `json:"title,omitempty"`
+	Sessions int            `json:"sessions"`
+	Unknown  int            `json:"unknownSize"` // Sessions of a file of unknown size
+	Buckets  map[string]int `json:"buckets"`
+}
+
+// Completion summarizes sessions per episode, sorted by episode.
+func Completion(sessions []Session) []CompletionReport {
+	reports := make(map[string]*CompletionReport)
+	for _, session := range sessions {
+		report, ok := reports[session.Episode]
+		if !ok {
+			report = &CompletionReport{Episode: session.Episode, Title: session.Title, Buckets: make(map[string]int)}
+			for _, bucket := range completionBuckets {
+				report.Buckets[bucket] = 0
+			}
+			reports[session.Episode] = report
+		}
+		report.Sessions++
+
+		fraction := session.Fraction()
+		if fraction < 0 {
+			report.Unknown++
+			continue
+		}
+		i := int(fraction * float64(len(completionBuckets)))
+		if i >= len(completionBuckets) {
+			i = len(completionBuckets) - 1
+		}
+		report.Buckets[completionBuckets[i]]++
+	}
+
+	result := make([]CompletionReport, 0, len(reports))
+	for _, report := range reports {
+		result = append(result, *report)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Episode < result[j].Episode })
+	return result
+}
@@ -0,0 +1,81 @@
+package caddy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ruvido/goSpotifyPodcastAnalytics/rss"
+)
+
+func TestBuildSessions(t *testing.T) {
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	episode := &rss.Episode{GUID: "ep-1", Title: "Pilot", Length: 1000}
+	request := func(offset time.Duration, ip string, rangeHeader string, size int64) LogData {
+		return LogData{
+			Time:      start.Add(offset),
+			RealIP:    ip,
+			UserAgent: "Overcast/3.0",
+			Host:      "pod.example.com",
+			URI:       "/e1.mp3",
+			Method:    "GET",
+			Status:    206,
+			Range:     rangeHeader,
+			Size:      size,
+			Kind:      kindAudio,
+			Episode:   episode,
+		}
+	}
+
+	sessions := BuildSessions([]LogData{
+		request(time.Minute, "10.0.0.1", "bytes=400-599", 200),
+		request(0, "10.0.0.1", "bytes=0-499", 500),
+		// The suffix range is placed with the enclosure size from the feed
+		request(2*time.Minute, "10.0.0.1", "bytes=-100", 100),
+		request(0, "10.0.0.2", "bytes=0-249", 250),
+		// A day later the same listener starts a new session
+		request(25*time.Hour, "10.0.0.1", "bytes=0-99", 100),
+	})
+
+	if len(sessions) != 3 {
+		t.Fatalf("got %d sessions, want 3", len(sessions))
+	}
+	want := []struct {
+		delivered int64
+		fraction  float64
+	}{{700, 0.7}, {250, 0.25}, {100, 0.1}}
+	for i, session := range sessions {
+		if session.Episode != "ep-1" || session.Title != "Pilot" {
+			t.Errorf("session %d: episode %q %q, want ep-1 Pilot", i, session.Episode, session.Title)
+		}
+		if session.FileSize != 1000 {
+			t.Errorf("session %d: file size %d, want the 1000 bytes of the enclosure", i, session.FileSize)
+		}
+		if got := session.Delivered(); got != want[i].delivered {
+			t.Errorf("session %d: delivered %d bytes, want %d", i, got, want[i].delivered)
+		}
+		if got := session.Fraction(); got != want[i].fraction {
+			t.Errorf("session %d: fraction %v, want %v", i, got, want[i].fraction)
+		}
+	}
+}
+
+func TestBuildSessionsSizeFromResponse(t *testing.T) {
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	sessions := BuildSessions([]LogData{
+		{Time: start, RealIP: "10.0.0.1", URI: "/e2.mp3", Status: 206, Size: 300,
+			ContentRange: "bytes 0-299/1200", Kind: kindAudio},
+		{Time: start.Add(time.Minute), RealIP: "10.0.0.2", URI: "/e2.mp3", Status: 206, Size: 300,
+			Range: "bytes=0-299", Kind: kindAudio},
+	})
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+	for i, session := range sessions {
+		if session.FileSize != 1200 {
+			t.Errorf("session %d: file size %d, want 1200 from the Content-Range", i, session.FileSize)
+		}
+		if got := session.Fraction(); got != 0.25 {
+			t.Errorf("session %d: fraction %v, want 0.25", i, got)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package caddy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// unmatchedShow labels the requests that no show route matched.
+const unmatchedShow = "unmatched"
+
+// showRoute sends the requests for host (any host when empty) whose path
+// starts with prefix (any path when empty) to show.
+type showRoute struct {
+	show   string
+	host   string
+	prefix string
+}
+
+// ShowRouter tells which show a request belongs to when one server hosts
+// several podcasts.
+type ShowRouter struct {
+	routes []showRoute
+	spec   string
+
+	mu        sync.Mutex     // Guards Unmatched: logs are parsed concurrently
+	Unmatched map[string]int // Requests matching no route, by host and first path segment
+}
+
+// ParseShows reads a comma separated list of show=route, where a route is
+// a host ("pod.example.com"), a path prefix ("/shows/daily/") or both
+// ("example.com/daily/"). A show can have several routes. Use the Spotify
+// show IDs as show names to line the counts up with Spotify's.
+func ParseShows(spec string) (*ShowRouter, error) {
+	router := &ShowRouter{Unmatched: make(map[string]int)}
+	var normalized []string
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		show, route, ok := strings.Cut(item, "=")
+		show, route = strings.TrimSpace(show), strings.TrimSpace(route)
+		if !ok || show == "" || route == "" {
+			return nil, fmt.Errorf("invalid show route %q: expected show=host, show=/prefix or show=host/prefix", item)
+		}
+		if show == unmatchedShow {
+			return nil, fmt.Errorf("invalid show route %q: %q is reserved", item, unmatchedShow)
+		}
+
+		r := showRoute{show: show}
+		if i := strings.IndexByte(route, '/'); i >= 0 {
+			r.host, r.prefix = route[:i], route[i:]
+		} else {
+			r.host = route
+		}
+		r.host = strings.ToLower(r.host)
+		router.routes = append(router.routes, r)
+		normalized = append(normalized, show+"="+r.host+r.prefix)
+	}
+	if len(router.routes) == 0 {
+		return nil, fmt.Errorf("no show route in %q", spec)
+	}
+
+	// The most specific route wins: host and prefix, then the longest prefix
+	sort.SliceStable(router.routes, func(i, j int) bool {
+		a, b := router.routes[i], router.routes[j]
+		if (a.host != "") != (b.host != "") {
+			return a.host != ""
+		}
+		return len(a.prefix) > len(b.prefix)
+	})
+	router.spec = strings.Join(normalized, ",")
+	return router, nil
+}
+
+// String lists the routes, identifying the setting in cache names.
+func (r *ShowRouter) String() string {
+	return r.spec
+}
+
+// Route returns the show of a request, or "unmatched".
+func (r *ShowRouter) Route(entry LogData) string {
+	host := strings.ToLower(entry.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	path, _, _ := strings.Cut(entry.URI, "?")
+
+	for _, route := range r.routes {
+		if route.host != "" && route.host != host {
+			continue
+		}
+		if !strings.HasPrefix(path, route.prefix) {
+			continue
+		}
+		return route.show
+	}
+
+	segment := "/"
+	if i := strings.IndexByte(strings.TrimPrefix(path, "/"), '/'); i >= 0 {
+		segment = path[:i+2]
+	}
+	r.mu.Lock()
+	r.Unmatched[host+segment]++
+	r.mu.Unlock()
+	return unmatchedShow
+}
+
+// UnmatchedReport is how many requests went to one host and first path
+// segment without matching any show.
+type UnmatchedReport struct {
+	Location string `json:"location"`
+	Requests int    `json:"requests"`
+}
+
+// Report lists where the unmatched requests went, most frequent first.
+func (r *ShowRouter) Report() []UnmatchedReport {
+	var report []UnmatchedReport
+	r.mu.Lock()
+	for location, n := range r.Unmatched {
+		report = append(report, UnmatchedReport{Location: location, Requests: n})
+	}
+	r.mu.Unlock()
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Requests != report[j].Requests {
+			return report[i].Requests > report[j].Requests
+		}
+		return report[i].Location < report[j].Location
+	})
+	return report
+}
+
+// incrementShow counts a stream or listener in the per-show breakdown.
+func incrementShow(ts TimeSeries, show string, isStream bool) TimeSeries {
+	if ts.Shows == nil {
+		ts.Shows = make(map[string]Counts)
+	}
+	counts := ts.Shows[show]
+	if isStream {
+		counts.Streams++
+	} else {
+		counts.Listeners++
+	}
+	ts.Shows[show] = counts
+	return ts
+}
@@ -0,0 +1,279 @@
+package caddy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// sketchPrecision is the number of hash bits choosing a register: 2^14
+// registers, 16KB per sketch once dense.
+const sketchPrecision = 14
+
+const sketchRegisters = 1 << sketchPrecision
+
+// SketchError is the relative standard error of the listeners estimated
+// by the sketches, 1.04/sqrt(registers): about 0.8%, so that 95% of the
+// estimates are within 1.6% of the true count.
+const SketchError = 1.04 / 128
+
+// sparseLimit is how many registers a sketch keeps in a map before
+// switching to a plain array, which is smaller from there on.
+const sparseLimit = sketchRegisters / 16
+
+// sketch is a HyperLogLog: it estimates how many distinct keys were added
+// in constant space, and sketches merge into the sketch of the union of
+// their keys, so that the listeners of any range of days can be estimated
+// from the days' sketches. Days with few listeners keep only the
+// registers they set.
+type sketch struct {
+	sparse map[uint16]uint8
+	dense  []uint8
+}
+
+func newSketch() *sketch {
+	return &sketch{sparse: make(map[uint16]uint8)}
+}
+
+// sketchHash hashes a key to the 64 bits a sketch needs, the same on every
+// run so that persisted sketches keep merging.
+func sketchHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV leaves the high bits poorly mixed: finish with splitmix64
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (s *sketch) add(key string) {
+	x := sketchHash(key)
+	index := uint16(x >> (64 - sketchPrecision))
+	rank := uint8(bits.LeadingZeros64(x<<sketchPrecision|1<<(sketchPrecision-1))) + 1
+	s.set(index, rank)
+}
+
+// set raises a register to rank.
+func (s *sketch) set(index uint16, rank uint8) {
+	if s.dense != nil {
+		s.dense[index] = max(s.dense[index], rank)
+		return
+	}
+	if rank > s.sparse[index] {
+		s.sparse[index] = rank
+	}
+	if len(s.sparse) > sparseLimit {
+		s.dense = make([]uint8, sketchRegisters)
+		for i, r := range s.sparse {
+			s.dense[i] = r
+		}
+		s.sparse = nil
+	}
+}
+
+// merge makes s the sketch of its keys and those of other.
+func (s *sketch) merge(other *sketch) {
+	if other == nil {
+		return
+	}
+	if other.dense != nil {
+		for i, rank := range other.dense {
+			if rank > 0 {
+				s.set(uint16(i), rank)
+			}
+		}
+		return
+	}
+	for i, rank := range other.sparse {
+		s.set(i, rank)
+	}
+}
+
+// estimate returns the number of distinct keys added, within SketchError.
+// It is the improved estimator of Ertl ("New cardinality estimation
+// algorithms for HyperLogLog sketches", 2017), which needs neither bias
+// tables nor a switch to linear counting for small counts.
+func (s *sketch) estimate() int {
+	if s == nil {
+		return 0
+	}
+	const q = 64 - sketchPrecision
+	var histogram [q + 2]int
+	if s.dense != nil {
+		for _, rank := range s.dense {
+			histogram[rank]++
+		}
+	} else {
+		histogram[0] = sketchRegisters - len(s.sparse)
+		for _, rank := range s.sparse {
+			histogram[rank]++
+		}
+	}
+
+	m := float64(sketchRegisters)
+	z := m * sketchTau(1-float64(histogram[q+1])/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + float64(histogram[k]))
+	}
+	z += m * sketchSigma(float64(histogram[0])/m)
+	return int(math.Round(m * m / (2 * math.Ln2 * z)))
+}
+
+func sketchSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		next := z + x*y
+		y += y
+		if next == z {
+			return z
+		}
+		z = next
+	}
+}
+
+func sketchTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		y *= 0.5
+		next := z - (1-x)*(1-x)*y
+		if next == z {
+			return z / 3
+		}
+		z = next
+	}
+}
+
+// MarshalJSON stores a sketch as base64: "s" followed by three bytes per
+// set register while sparse, "d" followed by every register once dense.
+func (s *sketch) MarshalJSON() ([]byte, error) {
+	var raw []byte
+	if s.dense != nil {
+		raw = append([]byte{'d'}, s.dense...)
+	} else {
+		indexes := make([]int, 0, len(s.sparse))
+		for i := range s.sparse {
+			indexes = append(indexes, int(i))
+		}
+		sort.Ints(indexes)
+		raw = make([]byte, 1, 1+3*len(indexes))
+		raw[0] = 's'
+		for _, i := range indexes {
+			raw = append(raw, byte(i>>8), byte(i), s.sparse[uint16(i)])
+		}
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(raw))
+}
+
+func (s *sketch) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid sketch: %w", err)
+	}
+	switch {
+	case len(raw) == 1+sketchRegisters && raw[0] == 'd':
+		s.sparse, s.dense = nil, raw[1:]
+	case len(raw) > 0 && (len(raw)-1)%3 == 0 && raw[0] == 's':
+		s.sparse, s.dense = make(map[uint16]uint8, (len(raw)-1)/3), nil
+		for i := 1; i < len(raw); i += 3 {
+			s.sparse[uint16(raw[i])<<8|uint16(raw[i+1])] = raw[i+2]
+		}
+	default:
+		return fmt.Errorf("invalid sketch of %d bytes", len(raw))
+	}
+	return nil
+}
+
+// reachKey names the episode a listener is sketched under: the feed item,
+// or the URI path on its host without the query string.
+func reachKey(entry LogData) string {
+	key, _, _ := strings.Cut(episodeKey(entry), "?")
+	return key
+}
+
+// Reach is the distinct listeners of a period, estimated from the daily
+// sketches instead of the exact listener keys, so that it stays cheap over
+// months and years. Margins are twice the standard error: 95% of the
+// estimates are closer than that to the true count.
+type Reach struct {
+	Listeners int            `json:"listeners"`
+	Margin    int            `json:"margin"`
+	Error     float64        `json:"error"`    // Relative standard error of every estimate
+	Episodes  []EpisodeReach `json:"episodes"` // Most listeners first
+}
+
+// EpisodeReach is the distinct listeners of one episode over a period.
+type EpisodeReach struct {
+	Episode   string `json:"episode"`         // GUID, or host and path without a feed
+	Title     string `json:"title,omitempty"` // From the feed
+	Listeners int    `json:"listeners"`
+	Margin    int    `json:"margin"`
+}
+
+// reachMargin is the 95% margin of an estimate.
+func reachMargin(estimate int) int {
+	return int(math.Ceil(2 * SketchError * float64(estimate)))
+}
+
+// Reach estimates the distinct listeners between startDate and endDate
+// (inclusive), overall and per episode, by merging the sketches of the
+// days. With IP anonymization listeners are told apart by their listener
+// pseudonym, which unlike the address pseudonyms does not change daily.
+func (a *Aggregator) Reach(startDate, endDate string) Reach {
+	total := newSketch()
+	episodes := make(map[string]*sketch)
+	for date, day := range a.Days {
+		if date < startDate || date > endDate {
+			continue
+		}
+		total.merge(day.Sketch)
+		for key, s := range day.EpisodeSketches {
+			union, ok := episodes[key]
+			if !ok {
+				union = newSketch()
+				episodes[key] = union
+			}
+			union.merge(s)
+		}
+	}
+
+	reach := Reach{Listeners: total.estimate(), Error: SketchError}
+	reach.Margin = reachMargin(reach.Listeners)
+	reach.Episodes = make([]EpisodeReach, 0, len(episodes))
+	for key, s := range episodes {
+		listeners := s.estimate()
+		reach.Episodes = append(reach.Episodes, EpisodeReach{
+			Episode:   key,
+			Title:     a.Titles[key],
+			Listeners: listeners,
+			Margin:    reachMargin(listeners),
+		})
+	}
+	sort.Slice(reach.Episodes, func(i, j int) bool {
+		if reach.Episodes[i].Listeners != reach.Episodes[j].Listeners {
+			return reach.Episodes[i].Listeners > reach.Episodes[j].Listeners
+		}
+		return reach.Episodes[i].Episode < reach.Episodes[j].Episode
+	})
+	return reach
+}
@@ -0,0 +1,110 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// errSkipLine marks a line that carries no request, such as a format
+// directive; it is counted as skipped rather than quarantined.
+var errSkipLine = errors.New("not a log entry")
+
+// Format decodes the lines of one kind of access log into LogData records.
+// Implementations may keep state between lines (e.g. a header that
+// declares the columns), so each file gets its own instance.
+type Format interface {
+	Parse(line []byte) (LogData, error)
+}
+
+// formats lists the supported access log formats by their config name.
+var formats = map[string]func() Format{
+	"caddy":      func() Format { return caddyFormat{} },
+	"combined":   func() Format { return combinedFormat{} },
+	"cloudfront": func() Format { return newCloudFrontFormat() },
+}
+
+// statelessFormats are the formats whose lines decode independently of
+// the lines before them, so that a log can be split between workers.
+var statelessFormats = map[string]bool{"caddy": true, "combined": true}
+
+func newFormat(name string) (Format, error) {
+	constructor, ok := formats[name]
+	if !ok {
+		names := make([]string, 0, len(formats))
+		for name := range formats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown log format %q (supported: %s)", name, strings.Join(names, ", "))
+	}
+	return constructor(), nil
+}
+
+// Source is one access log file together with the format it is written in.
+// A path such as "tcp://127.0.0.1:9000" names a network address instead,
+// where the collect command receives the log (see Collect).
+type Source struct {
+	Path   string
+	Format string
+}
+
+// Network returns the network ("tcp" or "udp") and address of a source
+// received over the network; ok is false for log files.
+func (s Source) Network() (network, address string, ok bool) {
+	network, address, ok = strings.Cut(s.Path, "://")
+	if !ok || (network != "tcp" && network != "udp") {
+		return "", "", false
+	}
+	return network, address, true
+}
+
+// ParseSources reads a comma separated list of path=format pairs, e.g.
+// "/var/log/caddy/access.log=caddy,/var/log/nginx/access.log=combined" or
+// "tcp://127.0.0.1:9000=caddy". A path without a format defaults to Caddy
+// JSON.
+func ParseSources(spec string) ([]Source, error) {
+	var sources []Source
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		source := Source{Path: item, Format: "caddy"}
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			source.Path = strings.TrimSpace(item[:i])
+			source.Format = strings.TrimSpace(item[i+1:])
+		}
+		if _, err := newFormat(source.Format); err != nil {
+			return nil, fmt.Errorf("log source %s: %w", source.Path, err)
+		}
+		sources = append(sources, source)
+	}
+
+	if len(sources) == 0 {
+		return nil, errors.New("no log source configured")
+	}
+	return sources, nil
+}
+
+// caddyFormat reads Caddy's JSON access log.
+type caddyFormat struct{}
+
+func (caddyFormat) Parse(line []byte) (LogData, error) {
+	// Decode the JSON as written: URL-decoding the whole line first would
+	// corrupt any header containing '%' or '+'.
+	var entry LogEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return LogData{}, err
+	}
+
+	// Only the URI is URL-encoded, so that is the only field to decode.
+	if uri, err := url.PathUnescape(entry.Request.URI); err == nil {
+		entry.Request.URI = uri
+	}
+	return newLogData(entry), nil
+}
@@ -0,0 +1,83 @@
+package caddy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCombinedFormat(t *testing.T) {
+	line := `81.2.69.1 - - [03/Jun/2024:14:05:09 +0200] "GET /episodes/ep%2001.mp3 HTTP/1.1" 206 1048576 "https://www.google.com/search?q=x" "Overcast/3.0 (+http://overcast.fm/; iOS podcast app)" "81.2.69.9, 10.0.0.2"`
+	entry, err := combinedFormat{}.Parse([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := time.Date(2024, 6, 3, 12, 5, 9, 0, time.UTC)
+	if !entry.Time.Equal(logged) {
+		t.Errorf("Time = %v, want %v", entry.Time, logged)
+	}
+	checkFields(t, map[string][2]any{
+		"URI":          {entry.URI, "/episodes/ep 01.mp3"},
+		"Method":       {entry.Method, "GET"},
+		"Status":       {entry.Status, 206},
+		"Size":         {entry.Size, int64(1048576)},
+		"UserAgent":    {entry.UserAgent, "Overcast/3.0 (+http://overcast.fm/; iOS podcast app)"},
+		"RemoteIP":     {entry.RemoteIP, "81.2.69.1"},
+		"ForwardedFor": {entry.ForwardedFor, "81.2.69.9, 10.0.0.2"},
+		"Referer":      {entry.Referer, "google.com"},
+	})
+
+	if _, err := (combinedFormat{}).Parse([]byte(`81.2.69.1 - - [03/Jun/2024:14:05:09 +0200] "GET / HTTP/1.1" 200`)); err == nil {
+		t.Error("a truncated line parsed")
+	}
+}
+
+func TestCloudFrontFormat(t *testing.T) {
+	f := newCloudFrontFormat()
+
+	// The directive reorders the columns and adds the range ones
+	fields := "#Fields: date time c-ip cs-method cs(Host) cs-uri-stem sc-status cs(Referer) cs(User-Agent) cs-uri-query sc-bytes x-host-header time-taken x-forwarded-for sc-range-start sc-range-end sc-content-len sc-content-type"
+	if _, err := f.Parse([]byte(fields)); err != errSkipLine {
+		t.Fatalf("directive: err = %v, want errSkipLine", err)
+	}
+
+	line := "2024-06-03\t12:05:09\t81.2.69.1\tGET\td111111abcdef8.cloudfront.net\t/episodes/ep%2001.mp3\t206\t-\t" +
+		"AppleCoreMedia/1.0.0.21E236%2520(iPhone;%2520U)\tsrc=rss\t1048576\tpod.example.com\t0.125\t-\t0\t1048575\t48000000\taudio/mpeg"
+	entry, err := f.Parse([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := time.Date(2024, 6, 3, 12, 5, 9, 0, time.UTC)
+	if !entry.Time.Equal(logged) {
+		t.Errorf("Time = %v, want %v", entry.Time, logged)
+	}
+	checkFields(t, map[string][2]any{
+		"URI":          {entry.URI, "/episodes/ep 01.mp3?src=rss"},
+		"Method":       {entry.Method, "GET"},
+		"Status":       {entry.Status, 206},
+		"Size":         {entry.Size, int64(1048576)},
+		"UserAgent":    {entry.UserAgent, "AppleCoreMedia/1.0.0.21E236 (iPhone; U)"},
+		"RemoteIP":     {entry.RemoteIP, "81.2.69.1"},
+		"ForwardedFor": {entry.ForwardedFor, ""},
+		"Host":         {entry.Host, "pod.example.com"},
+		"Referer":      {entry.Referer, ""},
+		"Duration":     {entry.Duration, 125 * time.Millisecond},
+		"ContentRange": {entry.ContentRange, "bytes 0-1048575/48000000"},
+		"ContentType":  {entry.ContentType, "audio/mpeg"},
+	})
+
+	if _, err := f.Parse([]byte("2024-06-03\t12:05:09\t81.2.69.1")); err == nil {
+		t.Error("a line with missing columns parsed")
+	}
+}
+
+// checkFields compares each named field with the value it should have.
+func checkFields(t *testing.T, fields map[string][2]any) {
+	t.Helper()
+	for name, field := range fields {
+		if field[0] != field[1] {
+			t.Errorf("%s = %v, want %v", name, field[0], field[1])
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package caddy
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ruvido/goSpotifyPodcastAnalytics/data"
+)
+
+// subscriberCarry is how long a reported subscriber count stands for an
+// aggregator that stops polling, or polls less than daily.
+const subscriberCarry = 7 * 24 * time.Hour
+
+// reportedSubscribers finds the count that feed fetchers put in their
+// User-Agent: "Feedly/1.0 (+http://www.feedly.com/fetcher.html; 123
+// subscribers)", "NewsBlur Feed Fetcher - 12 subscribers", "Overcast/1.0
+// Podcast Sync (45 subscribers; feed-id=678)", "subscribers=9"...
+var reportedSubscribers = regexp.MustCompile(`(?i)(\d+)\s*(?:subscribers?|readers?|followers?)\b|\b(?:subscribers?|readers?)\s*[=:]\s*(\d+)`)
+
+// feedID tells apart the feeds an aggregator reports on, when it fetches
+// the same show under several URLs.
+var feedID = regexp.MustCompile(`(?i)feed-?id[=: ]\s*(\w+)`)
+
+// subscriberCount returns the subscribers and feed ID reported by a feed
+// fetcher's User-Agent; ok is false when it reports none.
+func subscriberCount(userAgent string) (count int, feed string, ok bool) {
+	m := reportedSubscribers.FindStringSubmatch(userAgent)
+	if m == nil {
+		return 0, "", false
+	}
+	value := m[1]
+	if value == "" {
+		value = m[2]
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, "", false
+	}
+	if id := feedID.FindStringSubmatch(userAgent); id != nil {
+		feed = id[1]
+	}
+	return count, feed, true
+}
+
+// pollerName names the app polling a feed: the app database entry, else
+// the first product token of the User-Agent ("Feedly/1.0 (...)" gives
+// "Feedly").
+func pollerName(entry LogData) string {
+	if entry.App != "" && entry.App != unknownApp {
+		return entry.App
+	}
+	name := strings.TrimSpace(entry.UserAgent)
+	if i := strings.IndexAny(name, "/ (;"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" {
+		return unknownApp
+	}
+	return name
+}
+
+// feedPoll reports whether a request fetched a feed, changed or not: a
+// 304 answer to a conditional request is a poll all the same.
+func feedPoll(entry LogData) bool {
+	if entry.Kind != kindFeed {
+		return false
+	}
+	return entry.Status == 0 || (entry.Status >= 200 && entry.Status <= 299) || entry.Status == 304
+}
+
+// SubscriberCount is how one app polled the feed on one day.
+type SubscriberCount struct {
+	Polls     int `json:"polls"`              // Feed requests
+	Clients   int `json:"clients"`            // Distinct polling clients (address and user agent)
+	Reported  int `json:"reported,omitempty"` // Subscribers reported in the User-Agent
+	Estimated int `json:"estimated"`          // Reported, or clients for apps that report none
+}
+
+// SubscribersDay is the estimated audience of the feed on one day.
+type SubscribersDay struct {
+	Date      string                     `json:"date"`
+	Estimated int                        `json:"estimated"`
+	Apps      map[string]SubscriberCount `json:"apps"`
+}
+
+// Subscribers estimates the feed subscribers per app and day from the
+// feed polls among records. Aggregators that report their subscribers (Feedly,
+// Inoreader, NewsBlur, Overcast...) count for the number they report,
+// summed over the feed IDs they give and carried over the days they skip,
+// for up to a week; every other app counts one subscriber per distinct
+// polling client. The records should be read with Options.AllResponses,
+// so that 304 Not Modified answers are not missing. Days run from the
+// first poll to the last.
+func Subscribers(records []LogData) []SubscribersDay {
+	type reported struct {
+		count int
+		at    time.Time
+	}
+	type appDay struct {
+		count   SubscriberCount
+		clients map[string]struct{}
+	}
+
+	days := make(map[string]map[string]*appDay)
+	reports := make(map[string]map[string]map[string]reported) // Date, app, feed ID
+	var first, last string
+	for _, entry := range records {
+		if !feedPoll(entry) {
+			continue
+		}
+		date := entry.Timestamp[:10]
+		if first == "" || date < first {
+			first = date
+		}
+		if date > last {
+			last = date
+		}
+
+		app := pollerName(entry)
+		if days[date] == nil {
+			days[date] = make(map[string]*appDay)
+		}
+		day, ok := days[date][app]
+		if !ok {
+			day = &appDay{clients: make(map[string]struct{})}
+			days[date][app] = day
+		}
+		day.count.Polls++
+		day.clients[entry.RealIP+entry.UserAgent] = struct{}{}
+
+		if count, feed, ok := subscriberCount(entry.UserAgent); ok {
+			if reports[date] == nil {
+				reports[date] = make(map[string]map[string]reported)
+			}
+			if reports[date][app] == nil {
+				reports[date][app] = make(map[string]reported)
+			}
+			// The latest count of the day stands
+			if r, seen := reports[date][app][feed]; !seen || !entry.Time.Before(r.at) {
+				reports[date][app][feed] = reported{count: count, at: entry.Time}
+			}
+		}
+	}
+	if first == "" {
+		return nil
+	}
+
+	var series []SubscribersDay
+	standing := make(map[string]map[string]reported) // App, feed ID: the last count
+	for _, date := range data.Days(first, last) {
+		for app, feeds := range reports[date] {
+			if standing[app] == nil {
+				standing[app] = make(map[string]reported)
+			}
+			for feed, r := range feeds {
+				standing[app][feed] = r
+			}
+		}
+
+		day := SubscribersDay{Date: date, Apps: make(map[string]SubscriberCount)}
+		for app, d := range days[date] {
+			d.count.Clients = len(d.clients)
+			day.Apps[app] = d.count
+		}
+		end, _ := time.ParseInLocation("2006-01-02", date, time.Local)
+		end = end.AddDate(0, 0, 1)
+		for app, feeds := range standing {
+			count := day.Apps[app]
+			for feed, r := range feeds {
+				if end.Sub(r.at) > subscriberCarry {
+					delete(feeds, feed)
+					continue
+				}
+				count.Reported += r.count
+			}
+			if count.Reported > 0 {
+				day.Apps[app] = count
+			}
+		}
+
+		for app, count := range day.Apps {
+			count.Estimated = count.Clients
+			if count.Reported > 0 {
+				count.Estimated = count.Reported
+			}
+			day.Apps[app] = count
+			day.Estimated += count.Estimated
+		}
+		series = append(series, day)
+	}
+	return series
+}
@@ -0,0 +1,119 @@
+package caddy
+
+import (
+	"sort"
+	"strings"
+)
+
+// Summary totals a period. Streams are summed over the days (a stream is a
+// per-day notion), while listeners are distinct over the whole period.
+type Summary struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Days  int    `json:"days"` // Days with any traffic
+
+	// Totals of the period; its date is the ISO 8601 interval start/end
+	Totals TimeSeries `json:"totals"`
+
+	// Distinct listeners estimated from the daily sketches, per episode too
+	Reach Reach `json:"reach"`
+
+	// Totals per hour, week, month or year of the period (see Rollup)
+	Buckets []TimeSeries `json:"buckets,omitempty"`
+}
+
+// Summary totals the days between startDate and endDate (inclusive).
+func (a *Aggregator) Summary(startDate, endDate string) Summary {
+	dates := make([]string, 0, len(a.Days))
+	for date := range a.Days {
+		if date >= startDate && date <= endDate {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+
+	days := make([]*dayState, 0, len(dates))
+	for _, date := range dates {
+		days = append(days, a.Days[date])
+	}
+
+	summary := Summary{Start: startDate, End: endDate, Days: len(dates)}
+	summary.Totals = totals(days)
+	summary.Totals.Date = startDate + "/" + endDate
+	summary.Reach = a.Reach(startDate, endDate)
+	return summary
+}
+
+// totals counts days (or hours) together: streams, downloads and page
+// views are summed, listeners and visitors are distinct over all of them.
+// A single day is counted exactly; over several days, listeners and
+// visitors are estimated from the merged sketches of the days, within
+// SketchError, since their keys do not outlive the day (see compact).
+func totals(days []*dayState) TimeSeries {
+	if len(days) == 1 {
+		return days[0].timeSeries()
+	}
+
+	var ts TimeSeries
+	listeners := newSketch()
+	sketches := make(map[string]*sketch)
+	for _, day := range days {
+		ts = addCounts(ts, day.counts(), false)
+		for category, n := range day.Downloads {
+			ts = addDownloads(ts, category, n)
+		}
+		ts.Webpage.Views += day.Views
+		listeners.merge(day.Sketch)
+		for dimension, s := range day.Sketches {
+			union, ok := sketches[dimension]
+			if !ok {
+				union = newSketch()
+				sketches[dimension] = union
+			}
+			union.merge(s)
+		}
+	}
+
+	ts.All.Listeners = listeners.estimate()
+	for dimension, s := range sketches {
+		ts = setListeners(ts, dimension, s.estimate())
+	}
+	return ts
+}
+
+// setListeners sets the listeners of one breakdown (see dimensions), or
+// the page visitors.
+func setListeners(ts TimeSeries, dimension string, n int) TimeSeries {
+	kind, name, _ := strings.Cut(dimension, ":")
+	set := func(breakdown map[string]Counts) map[string]Counts {
+		if breakdown == nil {
+			breakdown = make(map[string]Counts)
+		}
+		counts := breakdown[name]
+		counts.Listeners = n
+		breakdown[name] = counts
+		return breakdown
+	}
+	switch kind {
+	case "c":
+		switch name {
+		case "web":
+			ts.Web.Listeners = n
+		case "spotify":
+			ts.Spotify.Listeners = n
+		case "other":
+			ts.Other.Listeners = n
+		default:
+			ts.Categories = set(ts.Categories)
+		}
+	case "a":
+		ts.Apps = set(ts.Apps)
+	case "g":
+		ts.Breakdown = set(ts.Breakdown)
+	case "s":
+		ts.Shows = set(ts.Shows)
+	case "v":
+		ts.Webpage.Visitors = n
+	}
+	return ts
+}
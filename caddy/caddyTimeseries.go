@@ -7,29 +7,98 @@ import (
 	"io"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"time"
-	"net/url"
 	"strings"
     "github.com/ruvido/goSpotifyPodcastAnalytics/data"
+    "github.com/ruvido/goSpotifyPodcastAnalytics/query"
+    "github.com/ruvido/goSpotifyPodcastAnalytics/rss"
 )
 
 type Request struct {
-	URI     string              `json:"uri"`
-	Headers map[string][]string `json:"headers"`
+	RemoteIP   string              `json:"remote_ip"`
+	RemoteAddr string              `json:"remote_addr"` // ip:port, before Caddy 2.5
+	ClientIP   string              `json:"client_ip"`
+	Method     string              `json:"method"`
+	Host       string              `json:"host"`
+	URI        string              `json:"uri"`
+	Headers    map[string][]string `json:"headers"`
 }
 
 type LogEntry struct {
 	Ts      float64 `json:"ts"`
 	Request Request `json:"request"`
+	Status  int     `json:"status"`
 	Size    int64   `json:"size"`
+
+	Duration caddyDuration `json:"duration"`
+
+	RespHeaders map[string][]string `json:"resp_headers"`
+}
+
+// caddyDuration decodes Caddy's duration field, logged in seconds by
+// default or as a Go duration string with duration_format "string".
+type caddyDuration time.Duration
+
+func (d *caddyDuration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = caddyDuration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration: %w", err)
+		}
+		*d = caddyDuration(parsed)
+	}
+	return nil
 }
 
 type LogData struct {
+	Time      time.Time // When the request was logged
 	Timestamp string // The formatted date and time string
-	RealIP    string // The real IP address extracted from headers
+	RealIP    string // The client address (see TrustedProxies.ClientIP)
 	URI       string // The URI from the log entry
 	UserAgent string // The User-Agent string extracted from headers
 	Size      int64  // The size of the log entry
+	Method    string // The HTTP method, if logged
+	Status    int    // The response status, if logged
+	Host      string // The requested virtual host, if logged
+	Referer   string // The domain of the Referer header (see refererDomain)
+	Kind      string // Audio, feed, page or asset (see requestKind)
+
+	Duration time.Duration // Time taken to serve the response, if logged
+
+	RemoteIP     string // The address of the connection, if logged
+	ForwardedFor string // The X-Forwarded-For request header
+	XRealIP      string // The X-Real-Ip request header
+
+	Range         string // The Range request header
+	ContentRange  string // The Content-Range response header
+	ContentLength int64  // The Content-Length response header
+	ContentType   string // The Content-Type response header
+
+	Bot string // The bot rule that matched this request, if any
+
+	Category string // The user-agent category, when set by rules
+
+	App    string // The podcast app, from the app database
+	Device string // The device type, from the app database
+	OS     string // The operating system, from the app database
+
+	Country string // ISO country code, from the GeoIP database
+	Region  string // Region name, from the GeoIP database
+	City    string // City name, from the GeoIP database
+
+	Episode *rss.Episode // The feed item requested, when a feed is configured
+	Show    string       // The show the request belongs to, when shows are configured
+
+	listener string // The listener pseudonym, with anonymization (see Anonymizer)
 }
 
 
@@ -39,16 +108,23 @@ type Result struct {
 }
 
 type TimeSeries struct {
-	Date    string `json:"date"`
-	All     Counts `json:"all"`
-	Web     Counts `json:"web"`
-	Spotify Counts `json:"spotify"`
-	Other   Counts `json:"other"`
+	Date    string     `json:"date"`
+	All     Counts     `json:"all"`
+	Web     Counts     `json:"web"`
+	Spotify Counts     `json:"spotify"`
+	Other   Counts     `json:"other"`
+	Webpage PageCounts `json:"webpage"` // Views of the web pages, not streams
+
+	Categories map[string]Counts `json:"categories,omitempty"` // Categories from user-agent rules
+	Apps       map[string]Counts `json:"apps,omitempty"`       // Only with an app database
+	Breakdown  map[string]Counts `json:"breakdown,omitempty"`  // Only with --by
+	Shows      map[string]Counts `json:"shows,omitempty"`      // Only with show routes
 }
 
 type Counts struct {
 	Streams   int `json:"streams"`
 	Listeners int `json:"listeners"`
+	Downloads int `json:"iabDownloads,omitempty"` // Only counted in IAB mode
 }
 
 type TimeAnalyticsDELME struct {
@@ -57,107 +133,138 @@ type TimeAnalyticsDELME struct {
 }
 
 
-func containsAny(uri, filter string) bool {
-	keywords := strings.Fields(filter)
 
-	for _, keyword := range keywords {
-		if !strings.Contains(uri, keyword) {
-			return false
-		}
-	}
-	return true
-}
 
-
-func ingestDataFromFile(filePath string) ([]LogEntry, error) {
+func ingestDataFromFile(filePath string, parser *lineParser) ([]LogData, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	var logEntries []LogEntry
+	var logEntries []LogData
 	reader := bufio.NewReader(file)
 	for {
-		line, _, err := reader.ReadLine()
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read line: %w", err)
+		}
+		if len(line) > 0 {
+			entry, ok, perr := parser.parse(line)
+			if perr != nil {
+				return nil, perr
+			}
+			if ok {
+				logEntries = append(logEntries, entry)
+			}
+		}
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to read line: %w", err)
-		}
+	}
 
-		// Clean the line by decoding URL-encoded characters
-		cleanLine, err := url.QueryUnescape(string(line))
-		if err != nil {
-			fmt.Printf("Failed to decode line: %v\n", err)
-			continue
-		}
+	return logEntries, nil
+}
 
-		// Ensure the line has enough content to be a valid log entry
-		if len(strings.TrimSpace(cleanLine)) == 0 || !strings.Contains(cleanLine, "}") {
-			fmt.Println("Skipping incomplete or malformed log entry")
-			continue
-		}
+// newLogData normalizes a decoded Caddy entry into a LogData record.
+func newLogData(entry LogEntry) LogData {
+	// Format the timestamp
+	timestamp := time.Unix(int64(entry.Ts), 0).Format("2006-01-02 15:04:05")
 
-		var entry LogEntry
-		if err := json.Unmarshal([]byte(cleanLine), &entry); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal JSON: %w", err)
-		}
+	// The connection address; the client one is resolved in admit
+	remoteIP := entry.Request.RemoteIP
+	if remoteIP == "" {
+		remoteIP = entry.Request.ClientIP
+	}
+	if remoteIP == "" {
+		remoteIP = entry.Request.RemoteAddr
+	}
 
+	// Extract the User-Agent
+	userAgent := ""
+	if uas, found := entry.Request.Headers["User-Agent"]; found && len(uas) > 0 {
+		userAgent = uas[0]
+	}
 
-		logEntries = append(logEntries, entry)
+	var contentLength int64
+	if values := entry.RespHeaders["Content-Length"]; len(values) > 0 {
+		contentLength, _ = strconv.ParseInt(values[0], 10, 64)
 	}
 
-	return logEntries, nil
+	return LogData{
+		Time:      time.Unix(0, int64(entry.Ts*1e9)),
+		Timestamp: timestamp,
+		URI:       entry.Request.URI,
+		UserAgent: userAgent,
+		Size:      entry.Size,
+		Method:    entry.Request.Method,
+		Status:    entry.Status,
+		Host:      entry.Request.Host,
+		Referer:   refererDomain(firstHeader(entry.Request.Headers, "Referer")),
+		Duration:  time.Duration(entry.Duration),
+
+		RemoteIP:     remoteIP,
+		ForwardedFor: strings.Join(entry.Request.Headers["X-Forwarded-For"], ","),
+		XRealIP:      firstHeader(entry.Request.Headers, "X-Real-Ip"),
+
+		Range:         firstHeader(entry.Request.Headers, "Range"),
+		ContentRange:  firstHeader(entry.RespHeaders, "Content-Range"),
+		ContentLength: contentLength,
+		ContentType:   firstHeader(entry.RespHeaders, "Content-Type"),
+	}
 }
 
-func LoadLogData(filePath string) []LogData {
-	logEntries, err := ingestDataFromFile(filePath)
-	if err != nil {
-		log.Fatalf("Failed to ingest data: %v", err)
+func firstHeader(headers map[string][]string, name string) string {
+	if values := headers[name]; len(values) > 0 {
+		return values[0]
 	}
+	return ""
+}
 
-	var logDataList []LogData
+// ReadLogData parses the whole log of source, sending unparseable lines
+// to opts.QuarantinePath, and returns the records that served any bytes.
+// Logs in a stateless format are decoded by opts.Workers goroutines.
+func ReadLogData(source Source, opts Options) ([]LogData, ParseStats, error) {
+	parser, err := newLineParser(source, opts)
+	if err != nil {
+		return nil, ParseStats{}, err
+	}
+	defer parser.Close()
 
-	for _, entry := range logEntries {
-		// Format the timestamp
-		timestamp := time.Unix(int64(entry.Ts), 0).Format("2006-01-02 15:04:05")
-
-		// Extract the real IP
-		realIP := ""
-		if ips, found := entry.Request.Headers["X-Real-Ip"]; found && len(ips) > 0 {
-			realIP = ips[0]
-		} else if ips, found := entry.Request.Headers["X-Forwarded-For"]; found && len(ips) > 0 {
-			realIP = ips[0]
-		}
+	if _, _, ok := source.Network(); ok {
+		logDataList, err := readArchive(source, opts, parser)
+		return logDataList, parser.Stats, err
+	}
+	if opts.parallel(source) {
+		logDataList, err := readLogDataParallel(source, opts, parser)
+		return logDataList, parser.Stats, err
+	}
 
-		// Extract the User-Agent
-		userAgent := ""
-		if uas, found := entry.Request.Headers["User-Agent"]; found && len(uas) > 0 {
-			userAgent = uas[0]
-		}
+	logEntries, err := ingestDataFromFile(source.Path, parser)
+	if err != nil {
+		return nil, parser.Stats, err
+	}
 
-		// Create an instance of LogData
-		logData := LogData{
-			Timestamp: timestamp,
-			RealIP:    realIP,
-			URI:       entry.Request.URI,
-			UserAgent: userAgent,
-			Size:      entry.Size,
-		}
+	var logDataList []LogData
 
+	for _, entry := range logEntries {
 		// Add to the list
-		if (entry.Size > 0 ) {
-			logDataList = append(logDataList, logData)		
+		if opts.admit(&entry) {
+			logDataList = append(logDataList, entry)
 		}
-	
+	}
+	return logDataList, parser.Stats, nil
+}
 
+func LoadLogData(filePath string) []LogData {
+	logDataList, _, err := ReadLogData(Source{Path: filePath, Format: "caddy"}, Options{})
+	if err != nil {
+		log.Fatalf("Failed to ingest data: %v", err)
 	}
 	return logDataList
 }
 
-func FilterLogData(data []LogData, startDate, endDate, filter string) []LogData {
+func FilterLogData(data []LogData, startDate, endDate string, filter *query.Query) []LogData {
 	// Parse the start and end dates
 	startDate = startDate + " 00:00:00"
 	endDate = endDate + " 23:59:59"
@@ -181,7 +288,7 @@ func FilterLogData(data []LogData, startDate, endDate, filter string) []LogData
 			continue
 		}
 
-		if (entryTime.Equal(start) || entryTime.After(start)) && entryTime.Before(end) && containsAny(entry.URI, filter) {
+		if (entryTime.Equal(start) || entryTime.After(start)) && entryTime.Before(end) && filter.Match(&entry) {
 			filteredData = append(filteredData, entry)
 		}
 	}
@@ -189,60 +296,60 @@ func FilterLogData(data []LogData, startDate, endDate, filter string) []LogData
 	return filteredData
 }
 
+// builtinCategories are the keywords classifyUserAgent looks for, in order.
+var builtinCategories = []struct {
+	category string
+	keywords []string
+}{
+	{"spotify", []string{"spotify"}},
+	{"web", []string{"chrome", "firefox", "safari", "edge", "msie", "opera", "mobile"}},
+}
+
 func classifyUserAgent(userAgent string) string {
+	category, _ := matchBuiltinCategory(userAgent)
+	return category
+}
+
+// matchBuiltinCategory returns the category of userAgent and the keyword
+// that decided it ("" for the "other" fallback).
+func matchBuiltinCategory(userAgent string) (category, keyword string) {
 	ua := strings.ToLower(userAgent)
 
-	if strings.Contains(ua, "spotify") {
-		return "spotify"
-	} else if strings.Contains(ua, "chrome") || strings.Contains(ua, "firefox") ||
-		strings.Contains(ua, "safari") || strings.Contains(ua, "edge") ||
-		strings.Contains(ua, "msie") || strings.Contains(ua, "opera") ||
-		strings.Contains(ua, "mobile") {
-		return "web"
-	} else {
-		return "other"
+	for _, builtin := range builtinCategories {
+		for _, keyword := range builtin.keywords {
+			if strings.Contains(ua, keyword) {
+				return builtin.category, keyword
+			}
+		}
 	}
+	return "other", ""
 }
 
 func CountStreamsAndListeners(data []LogData) Result {
-	streamsMap := make(map[string]map[string]struct{})
-	listenersMap := make(map[string]map[string]struct{})
-	dateCount := make(map[string]TimeSeries)
-
-	for _, entry := range data {
-		if entry.Size <= 0 {
-			continue
-		}
-
-		date := entry.Timestamp[:10] // Extract the date (YYYY-MM-DD)
-		category := classifyUserAgent(entry.UserAgent)
-
-		epKey := entry.URI + entry.RealIP + entry.UserAgent
-		listenerKey := entry.RealIP + entry.UserAgent
-
-		if _, ok := streamsMap[date]; !ok {
-			streamsMap[date] = make(map[string]struct{})
-			listenersMap[date] = make(map[string]struct{})
-		}
+	return Count(data, Options{})
+}
 
-		if _, seen := streamsMap[date][epKey]; !seen {
-			streamsMap[date][epKey] = struct{}{}
-			dateCount[date] = incrementCount(dateCount[date], category, true)
-			// if (category=="other") { fmt.Println(entry.UserAgent)}
-		}
+// Count is CountStreamsAndListeners with the counting modes of opts.
+func Count(data []LogData, opts Options) Result {
+	return Aggregate(data, opts).Result()
+}
 
-		if _, seen := listenersMap[date][listenerKey]; !seen {
-			listenersMap[date][listenerKey] = struct{}{}
-			dateCount[date] = incrementCount(dateCount[date], category, false)
-		}
+// Aggregate feeds records into a new Aggregator set up for opts.
+func Aggregate(data []LogData, opts Options) *Aggregator {
+	agg := NewAggregator()
+	agg.configure(opts)
+	if opts.IAB != nil {
+		// Download windows assume requests arrive in time order, which
+		// records from several logs do not
+		sorted := make([]LogData, len(data))
+		copy(sorted, data)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+		data = sorted
 	}
-
-	var result Result
-	for _, v := range dateCount {
-		result.TimeSeries = append(result.TimeSeries, v)
+	for _, entry := range data {
+		agg.Add(entry)
 	}
-
-	return result
+	return agg
 }
 
 func incrementCount(ts TimeSeries, category string, isStream bool) TimeSeries {
@@ -255,6 +362,10 @@ func incrementCount(ts TimeSeries, category string, isStream bool) TimeSeries {
 			ts.Spotify.Streams++
 		case "other":
 			ts.Other.Streams++
+		default:
+			counts := ts.category(category)
+			counts.Streams++
+			ts.Categories[category] = counts
 		}
 	} else {
 		ts.All.Listeners++
@@ -265,12 +376,30 @@ func incrementCount(ts TimeSeries, category string, isStream bool) TimeSeries {
 			ts.Spotify.Listeners++
 		case "other":
 			ts.Other.Listeners++
+		default:
+			counts := ts.category(category)
+			counts.Listeners++
+			ts.Categories[category] = counts
 		}
 	}
 	return ts
 }
 
+// category returns the counts of a category defined by the user-agent
+// rules, making room for it.
+func (ts *TimeSeries) category(name string) Counts {
+	if ts.Categories == nil {
+		ts.Categories = make(map[string]Counts)
+	}
+	return ts.Categories[name]
+}
+
 func OutputResult(result Result, outputFilePath string) error {
+	return OutputJSON(result, outputFilePath)
+}
+
+// OutputJSON prints any report as JSON and optionally saves it to a file.
+func OutputJSON(result interface{}, outputFilePath string) error {
 	encoder := json.NewEncoder(os.Stdout)
 	encoder.SetIndent("", "")
 
@@ -299,9 +428,61 @@ func OutputResult(result Result, outputFilePath string) error {
 	return nil
 }
 
-func TimeAnalytics(startDate, endDate, source string ) (map[string][]data.DailyAnalytics, error) {
-    // Create a map to combine the data
-    dataMap := make(map[string][]data.DailyAnalytics)
-    dataMap[source] = []data.DailyAnalytics{}
-    return dataMap, nil
+// TimeAnalytics counts the logs of sources between startDate and endDate
+// into per-platform series, the shape spotify.TimeAnalytics returns: one
+// series per user-agent category ("web", "spotify", "other" and any rule
+// categories) and, with an app database or show routes, one per app
+// ("app/Overcast") or show ("show/<id>").
+func TimeAnalytics(startDate, endDate string, sources []Source, opts Options) (map[string][]data.DailyAnalytics, error) {
+	var logData []LogData
+	for _, source := range sources {
+		sourceData, _, err := ReadLogData(source, opts)
+		if err != nil {
+			return nil, err
+		}
+		logData = append(logData, sourceData...)
+	}
+	filteredData := FilterLogData(logData, startDate, endDate, opts.Filter)
+	result := FilterResult(Count(filteredData, opts), startDate, endDate)
+
+	// Every series covers every day, even those a category or app is absent
+	dataMap := map[string][]data.DailyAnalytics{"web": nil, "spotify": nil, "other": nil}
+	for _, ts := range result.TimeSeries {
+		for category := range ts.Categories {
+			dataMap[category] = nil
+		}
+		for app := range ts.Apps {
+			dataMap["app/"+app] = nil
+		}
+		for show := range ts.Shows {
+			dataMap["show/"+show] = nil
+		}
+	}
+	for name := range dataMap {
+		series := make([]data.DailyAnalytics, 0, len(result.TimeSeries))
+		for _, ts := range result.TimeSeries {
+			var counts Counts
+			switch {
+			case name == "web":
+				counts = ts.Web
+			case name == "spotify":
+				counts = ts.Spotify
+			case name == "other":
+				counts = ts.Other
+			case strings.HasPrefix(name, "app/"):
+				counts = ts.Apps[strings.TrimPrefix(name, "app/")]
+			case strings.HasPrefix(name, "show/"):
+				counts = ts.Shows[strings.TrimPrefix(name, "show/")]
+			default:
+				counts = ts.Categories[name]
+			}
+			series = append(series, data.DailyAnalytics{
+				Date:      ts.Date,
+				Streams:   counts.Streams,
+				Listeners: counts.Listeners,
+			})
+		}
+		dataMap[name] = series
+	}
+	return dataMap, nil
 }
@@ -0,0 +1,153 @@
+package caddy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UARule maps the User-Agents matching Pattern to Category.
+type UARule struct {
+	Line     int            // Line of the rule file
+	Priority int            // Higher priorities are tried first
+	Category string         // Category of the matching requests
+	Pattern  *regexp.Regexp // nil for a catch-all
+}
+
+func (r UARule) String() string {
+	pattern := "*"
+	if r.Pattern != nil {
+		pattern = r.Pattern.String()
+	}
+	return fmt.Sprintf("line %d: %d %s %s", r.Line, r.Priority, r.Category, pattern)
+}
+
+var uaRuleLine = regexp.MustCompile(`^(\S+)\s+(\S+)\s+(.+)$`)
+
+// Classifier assigns a category to User-Agents from an ordered list of
+// rules, falling back to classifyUserAgent when none matches.
+type Classifier struct {
+	rules []UARule
+}
+
+// LoadClassifier reads a rule file with one rule per line:
+//
+//	# priority category pattern
+//	100 internal (?i)^OurPlayer/
+//	90  bot      (?i)qa-bot
+//	0   other    *
+//
+// Rules are tried from the highest priority down, in file order among
+// equal priorities. The pattern "*" matches everything (a catch-all).
+func LoadClassifier(path string) (*Classifier, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user-agent rules: %w", err)
+	}
+	defer file.Close()
+
+	classifier := &Classifier{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// The pattern is the rest of the line, spaces included
+		fields := uaRuleLine.FindStringSubmatch(line)
+		if fields == nil {
+			return nil, fmt.Errorf("%s:%d: expected \"priority category pattern\"", path, lineNumber)
+		}
+		priority, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid priority %q", path, lineNumber, fields[1])
+		}
+
+		rule := UARule{Line: lineNumber, Priority: priority, Category: fields[2]}
+		if expr := fields[3]; expr != "*" {
+			rule.Pattern, err = regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid pattern: %w", path, lineNumber, err)
+			}
+		}
+		classifier.rules = append(classifier.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read user-agent rules: %w", err)
+	}
+
+	sort.SliceStable(classifier.rules, func(i, j int) bool {
+		return classifier.rules[i].Priority > classifier.rules[j].Priority
+	})
+	return classifier, nil
+}
+
+// match returns the first rule matching userAgent.
+func (c *Classifier) match(userAgent string) (UARule, bool) {
+	for _, rule := range c.rules {
+		if rule.Pattern == nil || rule.Pattern.MatchString(userAgent) {
+			return rule, true
+		}
+	}
+	return UARule{}, false
+}
+
+// Classify returns the category of userAgent.
+func (c *Classifier) Classify(userAgent string) string {
+	if rule, ok := c.match(userAgent); ok {
+		return rule.Category
+	}
+	return classifyUserAgent(userAgent)
+}
+
+// Explanation tells how a User-Agent was classified.
+type Explanation struct {
+	UserAgent string `json:"userAgent"`
+	Category  string `json:"category"`
+	Rule      string `json:"rule"`
+	App       string `json:"app,omitempty"`
+	Device    string `json:"device,omitempty"`
+	OS        string `json:"os,omitempty"`
+	Bot       string `json:"bot,omitempty"`
+}
+
+// ExplainUserAgent classifies userAgent the way counting would with opts,
+// naming the rule responsible at each step.
+func ExplainUserAgent(userAgent string, opts Options) Explanation {
+	explanation := Explanation{UserAgent: userAgent}
+
+	if opts.Classifier != nil {
+		if rule, ok := opts.Classifier.match(userAgent); ok {
+			explanation.Category = rule.Category
+			explanation.Rule = rule.String()
+		}
+	}
+	if explanation.Rule == "" {
+		category, keyword := matchBuiltinCategory(userAgent)
+		explanation.Category = category
+		explanation.Rule = "built-in: no keyword matched"
+		if keyword != "" {
+			explanation.Rule = fmt.Sprintf("built-in: contains %q", keyword)
+		}
+	}
+
+	entry := LogData{UserAgent: userAgent}
+	if opts.Apps != nil {
+		opts.Apps.Identify(&entry)
+		explanation.App, explanation.Device, explanation.OS = entry.App, entry.Device, entry.OS
+	}
+	if opts.Bots != nil {
+		explanation.Bot, _ = opts.Bots.match(entry)
+	}
+	if explanation.Bot == "" && opts.Apps != nil {
+		explanation.Bot, _ = opts.Apps.Bot(userAgent)
+	}
+	return explanation
+}
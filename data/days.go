@@ -0,0 +1,46 @@
+package data
+
+import (
+	"time"
+)
+
+// dateLayout is how days are written in every series.
+const dateLayout = "2006-01-02"
+
+// Days lists every day from startDate to endDate (YYYY-MM-DD), both
+// included. It is empty when either date is invalid or the range is
+// reversed.
+func Days(startDate, endDate string) []string {
+	start, err := time.Parse(dateLayout, startDate)
+	if err != nil {
+		return nil
+	}
+	end, err := time.Parse(dateLayout, endDate)
+	if err != nil {
+		return nil
+	}
+
+	var days []string
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		days = append(days, day.Format(dateLayout))
+	}
+	return days
+}
+
+// FillGaps returns series restricted to the days from startDate to endDate,
+// sorted, with a zero entry for every day that has no data.
+func FillGaps(series []DailyAnalytics, startDate, endDate string) []DailyAnalytics {
+	byDate := make(map[string]DailyAnalytics, len(series))
+	for _, day := range series {
+		byDate[day.Date] = day
+	}
+
+	days := Days(startDate, endDate)
+	filled := make([]DailyAnalytics, 0, len(days))
+	for _, date := range days {
+		day := byDate[date]
+		day.Date = date
+		filled = append(filled, day)
+	}
+	return filled
+}
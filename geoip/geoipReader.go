@@ -0,0 +1,389 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+)
+
+// metadataMarker precedes the metadata map at the end of a MaxMind DB file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// Data section field types of the MaxMind DB format.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxCached is how many addresses a Reader remembers the location of. A
+// long collect run keeps meeting new addresses: once full, the cache starts
+// over rather than growing without bound.
+const maxCached = 1 << 16
+
+// Location is what a lookup tells about an address.
+type Location struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 code, e.g. "IT"
+	Region  string `json:"region,omitempty"`  // First subdivision, e.g. "Lombardy"
+	City    string `json:"city,omitempty"`    // English city name
+}
+
+// Reader looks addresses up in a MaxMind DB (.mmdb) file, such as the
+// GeoLite2 City or Country databases. It works fully offline.
+type Reader struct {
+	buf        []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	treeSize   uint64
+	ipv4Start  uint64
+
+	mu    sync.RWMutex // Guards cache, for concurrent lookups
+	cache map[string]Location
+
+	DatabaseType string
+}
+
+// Open reads a .mmdb file into memory.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+
+	start := bytes.LastIndex(buf, metadataMarker)
+	if start < 0 {
+		return nil, errors.New("invalid GeoIP database: metadata not found")
+	}
+	start += len(metadataMarker)
+
+	meta := decoder{buf: buf[start:]}
+	value, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP database metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid GeoIP database metadata: not a map")
+	}
+
+	r := &Reader{buf: buf, cache: make(map[string]Location)}
+	r.nodeCount, _ = metadata["node_count"].(uint64)
+	r.recordSize, _ = metadata["record_size"].(uint64)
+	r.ipVersion, _ = metadata["ip_version"].(uint64)
+	r.DatabaseType, _ = metadata["database_type"].(string)
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("invalid GeoIP database: unsupported record size %d", r.recordSize)
+	}
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	if r.treeSize+16 > uint64(start) {
+		return nil, errors.New("invalid GeoIP database: search tree larger than file")
+	}
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree
+	if r.ipVersion == 6 {
+		node := uint64(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a tree node.
+func (r *Reader) record(node uint64, bit byte) uint64 {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6:]
+		if bit == 0 {
+			return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3])<<16 | uint64(b[4])<<8 | uint64(b[5])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint64(b[3]&0xF0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0F)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		b := r.buf[node*8:]
+		if bit == 0 {
+			return uint64(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint64(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// find walks the search tree and returns the raw record for ip, or ok
+// false when the address is not in the database.
+func (r *Reader) find(ip net.IP) (value interface{}, ok bool, err error) {
+	node := uint64(0)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, false, nil
+	}
+
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, false, nil
+	}
+	if node < r.nodeCount {
+		return nil, false, errors.New("invalid GeoIP database: search tree too deep")
+	}
+
+	data := decoder{buf: r.buf[r.treeSize+16:]}
+	value, _, err = data.decode(node - r.nodeCount - 16)
+	return value, err == nil, err
+}
+
+// Lookup returns the location of an address given as a string. Unknown or
+// unparseable addresses yield an empty Location.
+func (r *Reader) Lookup(address string) (Location, error) {
+	r.mu.RLock()
+	location, ok := r.cache[address]
+	r.mu.RUnlock()
+	if ok {
+		return location, nil
+	}
+
+	if ip := net.ParseIP(address); ip != nil {
+		value, ok, err := r.find(ip)
+		if err != nil {
+			return location, err
+		}
+		if ok {
+			location = locationFrom(value)
+		}
+	}
+	r.mu.Lock()
+	if len(r.cache) >= maxCached {
+		r.cache = make(map[string]Location)
+	}
+	r.cache[address] = location
+	r.mu.Unlock()
+	return location, nil
+}
+
+// locationFrom picks the fields of a GeoIP2/GeoLite2 record we report.
+func locationFrom(value interface{}) Location {
+	var location Location
+	record, _ := value.(map[string]interface{})
+
+	if country, ok := record["country"].(map[string]interface{}); ok {
+		location.Country, _ = country["iso_code"].(string)
+	}
+	if subdivisions, ok := record["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		subdivision, _ := subdivisions[0].(map[string]interface{})
+		location.Region = englishName(subdivision)
+		if location.Region == "" {
+			location.Region, _ = subdivision["iso_code"].(string)
+		}
+	}
+	if city, ok := record["city"].(map[string]interface{}); ok {
+		location.City = englishName(city)
+	}
+	return location
+}
+
+func englishName(record map[string]interface{}) string {
+	names, _ := record["names"].(map[string]interface{})
+	name, _ := names["en"].(string)
+	return name
+}
+
+// decoder reads values from a MaxMind DB data section.
+type decoder struct {
+	buf []byte
+}
+
+func (d decoder) byteAt(offset uint64) (byte, error) {
+	if offset >= uint64(len(d.buf)) {
+		return 0, errors.New("unexpected end of data")
+	}
+	return d.buf[offset], nil
+}
+
+func (d decoder) slice(offset, size uint64) ([]byte, error) {
+	if offset+size > uint64(len(d.buf)) {
+		return nil, errors.New("unexpected end of data")
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+// decode reads the value at offset and returns it with the offset just
+// past it.
+func (d decoder) decode(offset uint64) (interface{}, uint64, error) {
+	control, err := d.byteAt(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+
+	kind := int(control >> 5)
+	if kind == typeExtended {
+		next, err := d.byteAt(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + int(next)
+		offset++
+	}
+
+	if kind == typePointer {
+		pointer, next, err := d.pointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+
+	size := uint64(control & 0x1F)
+	if size >= 29 {
+		extra := size - 28
+		b, err := d.slice(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		switch size {
+		case 29:
+			size = 29 + n
+		case 30:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint64(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, after, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, _ := key.(string)
+			m[name] = value
+			offset = after
+		}
+		return m, offset, nil
+
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint64(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.slice(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+
+	switch kind {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case typeInt32:
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	case typeContainer, typeEndMarker:
+		return nil, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
+
+// pointer resolves a pointer whose control byte was already read.
+func (d decoder) pointer(control byte, offset uint64) (pointer, next uint64, err error) {
+	size := uint64((control>>3)&0x3) + 1
+	b, err := d.slice(offset, size)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	vvv := uint64(control & 0x7)
+	n := uint64(0)
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	switch size {
+	case 1:
+		pointer = vvv<<8 | n
+	case 2:
+		pointer = (vvv<<16 | n) + 2048
+	case 3:
+		pointer = (vvv<<24 | n) + 526336
+	default:
+		pointer = n
+	}
+	return pointer, offset + size, nil
+}
@@ -0,0 +1,363 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// encodeValue writes value in the MaxMind DB data section format.
+func encodeValue(value interface{}) []byte {
+	var kind int
+	var payload []byte
+	size := -1
+	switch v := value.(type) {
+	case string:
+		kind, payload = typeString, []byte(v)
+	case []byte:
+		kind, payload = typeBytes, v
+	case float64:
+		kind, payload = typeDouble, binary.BigEndian.AppendUint64(nil, math.Float64bits(v))
+	case float32:
+		kind, payload = typeFloat, binary.BigEndian.AppendUint32(nil, math.Float32bits(v))
+	case uint16:
+		kind, payload = typeUint16, trimLeadingZeros(binary.BigEndian.AppendUint16(nil, v))
+	case uint32:
+		kind, payload = typeUint32, trimLeadingZeros(binary.BigEndian.AppendUint32(nil, v))
+	case uint64:
+		kind, payload = typeUint64, trimLeadingZeros(binary.BigEndian.AppendUint64(nil, v))
+	case int32:
+		kind, payload = typeInt32, binary.BigEndian.AppendUint32(nil, uint32(v))
+	case bool:
+		kind, size = typeBool, 0
+		if v {
+			size = 1
+		}
+	case []interface{}:
+		kind, size = typeArray, len(v)
+		for _, item := range v {
+			payload = append(payload, encodeValue(item)...)
+		}
+	case map[string]interface{}:
+		kind, size = typeMap, len(v)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			payload = append(payload, encodeValue(key)...)
+			payload = append(payload, encodeValue(v[key])...)
+		}
+	default:
+		panic(fmt.Sprintf("cannot encode %T", value))
+	}
+	if size < 0 {
+		size = len(payload)
+	}
+	return append(controlBytes(kind, size), payload...)
+}
+
+func trimLeadingZeros(b []byte) []byte {
+	return bytes.TrimLeft(b, "\x00")
+}
+
+// controlBytes is the control byte of a field, with its extended type and
+// size bytes when needed.
+func controlBytes(kind, size int) []byte {
+	var sizeBits byte
+	var extra []byte
+	switch {
+	case size < 29:
+		sizeBits = byte(size)
+	case size < 285:
+		sizeBits, extra = 29, []byte{byte(size - 29)}
+	case size < 65821:
+		sizeBits, extra = 30, binary.BigEndian.AppendUint16(nil, uint16(size-285))
+	default:
+		n := size - 65821
+		sizeBits, extra = 31, []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	if kind > 7 {
+		return append([]byte{sizeBits, byte(kind - 7)}, extra...)
+	}
+	return append([]byte{byte(kind)<<5 | sizeBits}, extra...)
+}
+
+// trieNode is a node of the search tree being written; a child is either
+// another node or, in leaf, one plus the data offset of a record.
+type trieNode struct {
+	child [2]*trieNode
+	leaf  [2]uint64
+	index uint64
+}
+
+// fixtureNetwork is one network of a fixture database and its record.
+type fixtureNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// writeFixture writes a MaxMind DB of the given networks, an IPv6 tree
+// (IPv4 under ::/96) unless ipVersion is 4, and returns its path.
+func writeFixture(t *testing.T, recordSize, ipVersion int, networks []fixtureNetwork) string {
+	t.Helper()
+	root := &trieNode{}
+	var data []byte
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		ip := ipnet.IP
+		if ipVersion == 6 && bits == 32 {
+			ip, ones = ipnet.IP.To16(), ones+96
+			copy(ip[:12], make([]byte, 12))
+		}
+		offset := uint64(len(data))
+		data = append(data, encodeValue(network.record)...)
+
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if i == ones-1 {
+				node.leaf[bit] = offset + 1
+				break
+			}
+			if node.child[bit] == nil {
+				node.child[bit] = &trieNode{}
+			}
+			node = node.child[bit]
+		}
+	}
+
+	var nodes []*trieNode
+	var number func(node *trieNode)
+	number = func(node *trieNode) {
+		node.index = uint64(len(nodes))
+		nodes = append(nodes, node)
+		for _, child := range node.child {
+			if child != nil {
+				number(child)
+			}
+		}
+	}
+	number(root)
+	nodeCount := uint64(len(nodes))
+
+	var tree []byte
+	for _, node := range nodes {
+		var records [2]uint64
+		for bit := range records {
+			switch {
+			case node.child[bit] != nil:
+				records[bit] = node.child[bit].index
+			case node.leaf[bit] != 0:
+				records[bit] = nodeCount + 16 + node.leaf[bit] - 1
+			default:
+				records[bit] = nodeCount
+			}
+		}
+		left, right := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24)<<4|byte(right>>24)&0x0F, byte(right>>16), byte(right>>8), byte(right))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, uint32(left))
+			tree = binary.BigEndian.AppendUint32(tree, uint32(right))
+		}
+	}
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, metadataMarker...)
+	file = append(file, encodeValue(map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test-City",
+	})...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func cityRecord(country, region, city string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": country},
+		"subdivisions": []interface{}{
+			map[string]interface{}{"iso_code": "XX", "names": map[string]interface{}{"en": region}},
+		},
+		"city": map[string]interface{}{"names": map[string]interface{}{"en": city, "it": city + "!"}},
+	}
+}
+
+var fixtureNetworks = []fixtureNetwork{
+	{"81.2.69.0/24", cityRecord("GB", "England", "London")},
+	{"2.125.160.0/20", cityRecord("IT", "Lombardy", "Milan")},
+	{"2001:db8::/32", cityRecord("DE", "Berlin", "Berlin")},
+	{"203.0.113.0/24", map[string]interface{}{"country": map[string]interface{}{"iso_code": "AU"}}},
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		address string
+		want    Location
+	}{
+		{"81.2.69.142", Location{Country: "GB", Region: "England", City: "London"}},
+		{"2.125.175.1", Location{Country: "IT", Region: "Lombardy", City: "Milan"}},
+		{"2.125.176.1", Location{}},
+		{"203.0.113.9", Location{Country: "AU"}},
+		{"2001:db8::1", Location{Country: "DE", Region: "Berlin", City: "Berlin"}},
+		{"2001:db9::1", Location{}},
+		{"not an address", Location{}},
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		t.Run(fmt.Sprint(recordSize), func(t *testing.T) {
+			reader, err := Open(writeFixture(t, recordSize, 6, fixtureNetworks))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reader.DatabaseType != "Test-City" {
+				t.Errorf("database type %q, want Test-City", reader.DatabaseType)
+			}
+			for _, test := range tests {
+				got, err := reader.Lookup(test.address)
+				if err != nil {
+					t.Errorf("%s: %v", test.address, err)
+				}
+				if got != test.want {
+					t.Errorf("%s: got %+v, want %+v", test.address, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupIPv4Tree(t *testing.T) {
+	reader, err := Open(writeFixture(t, 24, 4, fixtureNetworks[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reader.Lookup("81.2.69.1"); got.City != "London" {
+		t.Errorf("81.2.69.1: got %+v, want London", got)
+	}
+	// IPv6 addresses are not in an IPv4 database
+	if got, _ := reader.Lookup("2001:db8::1"); got != (Location{}) {
+		t.Errorf("2001:db8::1: got %+v, want nothing", got)
+	}
+}
+
+func TestLookupCacheIsBounded(t *testing.T) {
+	reader, err := Open(writeFixture(t, 24, 6, fixtureNetworks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= maxCached; i++ {
+		address := fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xFF, i&0xFF)
+		if _, err := reader.Lookup(address); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reader.cache) > maxCached {
+		t.Errorf("cache holds %d addresses, want at most %d", len(reader.cache), maxCached)
+	}
+	if got, _ := reader.Lookup("81.2.69.142"); got.City != "London" {
+		t.Errorf("lookup after the cache started over: got %+v", got)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	long := string(bytes.Repeat([]byte("a"), 300))
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{"string", encodeValue("Milan"), "Milan"},
+		{"long string", encodeValue(long), long},
+		{"bytes", encodeValue([]byte{1, 2, 3}), []byte{1, 2, 3}},
+		{"double", encodeValue(45.5), 45.5},
+		{"float", encodeValue(float32(1.5)), 1.5},
+		{"uint16", encodeValue(uint16(443)), uint64(443)},
+		{"uint32", encodeValue(uint32(1 << 30)), uint64(1 << 30)},
+		{"uint64", encodeValue(uint64(1 << 40)), uint64(1 << 40)},
+		{"zero", encodeValue(uint32(0)), uint64(0)},
+		{"int32", encodeValue(int32(-5)), int64(-5)},
+		{"true", encodeValue(true), true},
+		{"false", encodeValue(false), false},
+		{"array", encodeValue([]interface{}{"a", uint16(1)}), []interface{}{"a", uint64(1)}},
+		{"map", encodeValue(map[string]interface{}{"en": "Rome", "geoname_id": uint32(3169070)}),
+			map[string]interface{}{"en": "Rome", "geoname_id": uint64(3169070)}},
+	}
+	for _, test := range tests {
+		got, next, err := decoder{buf: test.data}.decode(0)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+		if next != uint64(len(test.data)) {
+			t.Errorf("%s: next offset %d, want %d", test.name, next, len(test.data))
+		}
+	}
+}
+
+func TestDecodePointers(t *testing.T) {
+	target := encodeValue("shared")
+	for _, test := range []struct {
+		name    string
+		pointer []byte
+		offset  int // Where the pointed value is placed
+	}{
+		{"1 byte", []byte{0x20 | 0x01, 0x02}, 0x102},
+		{"2 bytes", []byte{0x28 | 0x01, 0x00, 0x10}, 0x10010 + 2048},
+		{"3 bytes", []byte{0x30, 0x00, 0x00, 0x20}, 0x20 + 526336},
+		{"4 bytes", []byte{0x38, 0x00, 0x00, 0x00, 0x40}, 0x40},
+	} {
+		data := make([]byte, test.offset+len(target))
+		copy(data[test.offset:], target)
+		// The pointer sits in front of what it points to
+		if test.offset < len(test.pointer) {
+			t.Fatalf("%s: pointer overlaps its target", test.name)
+		}
+		copy(data, test.pointer)
+
+		got, next, err := decoder{buf: data}.decode(0)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != "shared" {
+			t.Errorf("%s: got %#v, want \"shared\"", test.name, got)
+		}
+		if next != uint64(len(test.pointer)) {
+			t.Errorf("%s: next offset %d, want %d past the pointer", test.name, next, len(test.pointer))
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	data := encodeValue(map[string]interface{}{"country": "IT"})
+	for n := 0; n < len(data); n++ {
+		if _, _, err := (decoder{buf: data[:n]}).decode(0); err == nil {
+			t.Errorf("decoding the first %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
 	// "crypto/sha256"
 	// "encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"io"
 	"log"
 	// "math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	// "strings"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	// "github.com/PuerkitoBio/goquery"
@@ -20,6 +25,9 @@ import (
     "github.com/ruvido/goSpotifyPodcastAnalytics/data"
 	"github.com/ruvido/goSpotifyPodcastAnalytics/spotify"
 	"github.com/ruvido/goSpotifyPodcastAnalytics/caddy"
+	"github.com/ruvido/goSpotifyPodcastAnalytics/geoip"
+	"github.com/ruvido/goSpotifyPodcastAnalytics/query"
+	"github.com/ruvido/goSpotifyPodcastAnalytics/rss"
 )
 
 var (
@@ -29,6 +37,14 @@ var (
 	filter            string
 	lastDays          int
 	outputJson		  string
+	noCache           bool
+	iab               bool
+	includeBots       bool
+	breakdown         string
+	listSpotify       bool
+	follow            bool
+	followInterval    time.Duration
+	bucket            string
 )
 
 func loadConfig() {
@@ -37,6 +53,19 @@ func loadConfig() {
 		log.Fatalf("Error reading .env file: %v", err)
 	}
 	viper.AutomaticEnv()
+	viper.SetDefault("CACHE_DIR", ".cache")
+	viper.SetDefault("LOG_FORMAT", "caddy")
+	viper.SetDefault("IAB_BITRATE", 128)
+	viper.SetDefault("BOTS_PATH", "bots.txt")
+	viper.SetDefault("APPS_PATH", "user-agents.json")
+	viper.SetDefault("UA_RULES_PATH", "ua-rules.txt")
+	viper.SetDefault("GEOIP_PATH", "GeoLite2-City.mmdb")
+	viper.SetDefault("TRUSTED_PROXIES", "private_ranges")
+	viper.SetDefault("IP_ANONYMIZATION", "hash")
+	viper.SetDefault("ANONYMIZE_KEY_PATH", ".cache/anonymize.key")
+	viper.SetDefault("QUARANTINE_PATH", ".cache/quarantine.log")
+	viper.SetDefault("PARSE_WORKERS", 0)
+	viper.SetDefault("COLLECT_ARCHIVE_KEEP", 30)
 }
 
 func getDateRange() (startDate, endDate string) {
@@ -170,32 +199,379 @@ var streamsCmd = &cobra.Command{
 	Short: "Get Podcast Streams",
 	Run: func(cmd *cobra.Command, args []string) {
         fmt.Println("> STREAMS")
-// 		startDate, endDate := getDateRange()
-// 		filePath := viper.GetString("LOG_PATH")
-// 		data := caddy.LoadLogData(filePath)
-// 		filteredData := caddy.FilterLogData(data, startDate, endDate, filter)
-// 		result := caddy.CountStreamsAndListeners(filteredData)
-// 		err := caddy.OutputResult(result, outputJson)
-// 		if err != nil {
-// 			fmt.Printf("Error saving result: %v\n", err)
-// 		}
-// 
-// 		//=======================================
-// 		out := SpotifyAnalytics("detailedStreams", startDate, endDate)
-// 		fmt.Println("spotify",out)
-// 		fmt.Println("")
-// 		//=======================================
+		startDate, endDate := getDateRange()
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+
+		if follow {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			emit := func(agg *caddy.Aggregator) error {
+				// Re-evaluate the window so a long follow rolls over midnight
+				startDate, endDate := getDateRange()
+				return caddy.OutputResult(rollup(agg, startDate, endDate), outputJson)
+			}
+			stats, err := caddy.Follow(ctx, sources, opts, followInterval, emit)
+			reportParseStats(stats)
+			if err != nil {
+				fmt.Printf("Error following log: %v\n", err)
+			}
+			return
+		}
+
+		agg, err := loadAggregate(sources, opts, startDate, endDate)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+
+		err = caddy.OutputResult(rollup(agg, startDate, endDate), outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
+	},
+}
+
+var collectCmd = &cobra.Command{
+	Use:   "collect",
+	Short: "Receive Caddy logs over TCP or UDP and keep the counts up to date",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("> COLLECT")
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		var network []caddy.Source
+		for _, source := range sources {
+			if _, _, ok := source.Network(); ok {
+				network = append(network, source)
+			}
+		}
+		if len(network) == 0 {
+			fmt.Println("Error in log configuration: no network source in LOG_SOURCES, e.g. tcp://127.0.0.1:9000=caddy")
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		for _, source := range network {
+			fmt.Fprintln(os.Stderr, "collect: listening on", source.Path)
+		}
+		stats, err := caddy.Collect(ctx, network, opts, followInterval, reportParseStats)
+		reportParseStats(stats)
+		if err != nil {
+			fmt.Printf("Error collecting log: %v\n", err)
+		}
+	},
+}
+
+// rollup returns the counts of the window per --bucket: one entry per day
+// by default, else per hour, ISO week, month or year, with listeners
+// distinct within each.
+func rollup(agg *caddy.Aggregator, startDate, endDate string) caddy.Result {
+	if bucket == "day" {
+		return caddy.FilterResult(agg.Result(), startDate, endDate)
+	}
+	return agg.Rollup(bucket, startDate, endDate)
+}
+
+// loadLogData reads every source in full, reporting the parse statistics
+// of each.
+func loadLogData(sources []caddy.Source, opts caddy.Options) ([]caddy.LogData, error) {
+	var data []caddy.LogData
+	for _, source := range sources {
+		sourceData, stats, err := caddy.ReadLogData(source, opts)
+		reportParseStats(stats)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, sourceData...)
+	}
+	return data, nil
+}
+
+var completenessCmd = &cobra.Command{
+	Use:   "completeness",
+	Short: "Estimate how much of each episode listeners downloaded",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("> COMPLETENESS")
+		startDate, endDate := getDateRange()
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+
+		data, err := loadLogData(sources, opts)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+		filteredData := caddy.FilterLogData(data, startDate, endDate, opts.Filter)
+		sessions := caddy.BuildSessions(filteredData)
+
+		err = caddy.OutputJSON(caddy.Completion(sessions), outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
+	},
+}
 
+var uaCmd = &cobra.Command{
+	Use:   "ua",
+	Short: "User-agent classification tools",
+}
+
+var uaExplainCmd = &cobra.Command{
+	Use:   "explain <user-agent>",
+	Short: "Show which rules classify a user agent",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var opts caddy.Options
+		if err := loadUserAgentRules(&opts); err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+
+		explanation := caddy.ExplainUserAgent(args[0], opts)
+		fmt.Printf("User-Agent: %s\n", explanation.UserAgent)
+		fmt.Printf("Category:   %s (%s)\n", explanation.Category, explanation.Rule)
+		if explanation.App != "" {
+			fmt.Printf("App:        %s, device %q, os %q\n", explanation.App, explanation.Device, explanation.OS)
+		}
+		if explanation.Bot != "" {
+			fmt.Printf("Bot:        %s\n", explanation.Bot)
+		}
 	},
 }
 
+// logSources lists the access logs to read: LOG_SOURCES (path=format,...)
+// when set, otherwise LOG_PATH in LOG_FORMAT.
+func logSources() ([]caddy.Source, error) {
+	if spec := viper.GetString("LOG_SOURCES"); spec != "" {
+		return caddy.ParseSources(spec)
+	}
+	return caddy.ParseSources(viper.GetString("LOG_PATH") + "=" + viper.GetString("LOG_FORMAT"))
+}
+
+// caddyOptions collects the caddy log settings from flags and config.
+func caddyOptions() (caddy.Options, error) {
+	filterQuery, err := query.Parse(filter)
+	if err != nil {
+		return caddy.Options{}, fmt.Errorf("--filter: %w", err)
+	}
+	opts := caddy.Options{
+		Filter:         filterQuery,
+		CacheDir:       viper.GetString("CACHE_DIR"),
+		QuarantinePath: viper.GetString("QUARANTINE_PATH"),
+		IncludeBots:    includeBots,
+		Hourly:         bucket == "hour",
+		Workers:        viper.GetInt("PARSE_WORKERS"),
+		ArchiveDir:     viper.GetString("COLLECT_ARCHIVE_DIR"),
+		ArchiveKeep:    viper.GetInt("COLLECT_ARCHIVE_KEEP"),
+	}
+	proxies, err := caddy.ParseTrustedProxies(viper.GetString("TRUSTED_PROXIES"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Proxies = proxies
+
+	// Without show routes every request belongs to the single show
+	if spec := viper.GetString("SHOWS"); spec != "" {
+		shows, err := caddy.ParseShows(spec)
+		if err != nil {
+			return opts, err
+		}
+		opts.Shows = shows
+	}
+
+	if iab {
+		opts.IAB = &caddy.IABOptions{
+			DefaultBitrate: viper.GetInt("IAB_BITRATE"),
+		}
+	}
+
+	if err := loadUserAgentRules(&opts); err != nil {
+		return opts, err
+	}
+
+	// The GeoIP database is optional too
+	if geoipPath := viper.GetString("GEOIP_PATH"); geoipPath != "" {
+		reader, err := geoip.Open(geoipPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return opts, err
+		}
+		opts.GeoIP = reader
+	}
+
+	if err := caddy.CheckBucket(bucket); err != nil {
+		return opts, fmt.Errorf("--bucket: %w", err)
+	}
+	if err := caddy.CheckBreakdown(breakdown); err != nil {
+		return opts, err
+	}
+	if (breakdown == "country" || breakdown == "region" || breakdown == "city") && opts.GeoIP == nil {
+		return opts, fmt.Errorf("--by %s needs a GeoIP database, set GEOIP_PATH to a .mmdb file", breakdown)
+	}
+	opts.By = breakdown
+
+	// The feed maps request URIs to episodes
+	if feedURL := viper.GetString("RSS_URL"); feedURL != "" {
+		feed, err := rss.Load(feedURL)
+		if err != nil {
+			return opts, err
+		}
+		opts.Feed = feed
+	}
+
+	// Client addresses are pseudonymized unless explicitly turned off
+	switch mode := viper.GetString("IP_ANONYMIZATION"); mode {
+	case "off":
+	case "hash", "truncate":
+		anonymizer, err := caddy.LoadAnonymizer(viper.GetString("ANONYMIZE_KEY_PATH"), mode == "truncate")
+		if err != nil {
+			return opts, err
+		}
+		opts.Anonymizer = anonymizer
+	default:
+		return opts, fmt.Errorf("unknown IP_ANONYMIZATION %q (supported: hash, truncate, off)", mode)
+	}
+	return opts, nil
+}
+
+// loadUserAgentRules loads the bot rules, podcast app database and
+// user-agent category rules into opts: everything ExplainUserAgent needs,
+// without the feed and databases only counting uses.
+func loadUserAgentRules(opts *caddy.Options) error {
+	// The bot rules are optional: without the file nothing is filtered
+	if botsPath := viper.GetString("BOTS_PATH"); botsPath != "" {
+		bots, err := caddy.LoadBotFilter(botsPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		opts.Bots = bots
+	}
+
+	// Same for the podcast app database
+	if appsPath := viper.GetString("APPS_PATH"); appsPath != "" {
+		apps, err := caddy.LoadAppDatabase(appsPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		opts.Apps = apps
+	}
+
+	// And for the user-agent category rules
+	if rulesPath := viper.GetString("UA_RULES_PATH"); rulesPath != "" {
+		classifier, err := caddy.LoadClassifier(rulesPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		opts.Classifier = classifier
+	}
+	return nil
+}
+
+// reportBots prints on stderr how many requests each bot rule matched.
+func reportBots(opts caddy.Options) {
+	if opts.Bots == nil {
+		return
+	}
+	action := "removed"
+	if opts.IncludeBots {
+		action = "tagged"
+	}
+	for _, rule := range opts.Bots.Report() {
+		fmt.Fprintf(os.Stderr, "bots: %d requests %s by %q\n", rule.Requests, action, rule.Rule)
+	}
+}
+
+// reportShows prints on stderr where the requests matching no show went,
+// to help complete the SHOWS routes.
+func reportShows(opts caddy.Options) {
+	if opts.Shows == nil {
+		return
+	}
+	for _, location := range opts.Shows.Report() {
+		fmt.Fprintf(os.Stderr, "shows: %d requests matched no show at %s\n", location.Requests, location.Location)
+	}
+}
+
+// reportParseStats prints the log parsing totals on stderr, keeping stdout
+// for the JSON output.
+func reportParseStats(stats caddy.ParseStats) {
+	fmt.Fprintln(os.Stderr, "caddy log:", stats)
+}
+
 
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List Podcast Episodes",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Listing episodes...")
-		// Implement listing logic here
+		fmt.Println("> LIST")
+		startDate, endDate := getDateRange()
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+
+		if listSpotify {
+			episodes, err := spotify.Episodes(startDate, endDate, opts.Feed, opts.Filter)
+			if err != nil {
+				fmt.Println("Error (spotify):", err)
+				return
+			}
+			if err := caddy.OutputJSON(episodes, outputJson); err != nil {
+				fmt.Printf("Error saving result: %v\n", err)
+			}
+			return
+		}
+
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+
+		data, err := loadLogData(sources, opts)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+		filteredData := caddy.FilterLogData(data, startDate, endDate, opts.Filter)
+
+		err = caddy.OutputJSON(caddy.Episodes(filteredData), outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
 	},
 }
 
@@ -203,18 +579,257 @@ var summaryCmd = &cobra.Command{
 	Use:   "summary",
 	Short: "Podcast Analytics Summary",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Analytics summary...")
-		// Implement summary logic here
+		fmt.Println("> SUMMARY")
+		startDate, endDate := getDateRange()
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+
+		agg, err := loadAggregate(sources, opts, startDate, endDate)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+
+		summary := agg.Summary(startDate, endDate)
+		if cmd.Flags().Changed("bucket") {
+			summary.Buckets = rollup(agg, startDate, endDate).TimeSeries
+		}
+		err = caddy.OutputJSON(summary, outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
+	},
+}
+
+// loadAggregate counts the configured logs, from the cache unless
+// --no-cache is given.
+func loadAggregate(sources []caddy.Source, opts caddy.Options, startDate, endDate string) (*caddy.Aggregator, error) {
+	if noCache {
+		data, err := loadLogData(sources, opts)
+		if err != nil {
+			return nil, err
+		}
+		filteredData := caddy.FilterLogData(data, startDate, endDate, opts.Filter)
+		return caddy.Aggregate(filteredData, opts), nil
+	}
+
+	agg, stats, err := caddy.IncrementalAggregate(sources, opts)
+	reportParseStats(stats)
+	return agg, err
+}
+
+var healthCmd = &cobra.Command{
+	Use:   "health",
+	Short: "Error rate and latency of audio delivery",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("> HEALTH")
+		startDate, endDate := getDateRange()
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+		// Errors seldom serve a body: keep them
+		opts.AllResponses = true
+
+		data, err := loadLogData(sources, opts)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+		filteredData := caddy.FilterLogData(data, startDate, endDate, opts.Filter)
+
+		err = caddy.OutputJSON(caddy.Health(filteredData), outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
+	},
+}
+
+var geographyCmd = &cobra.Command{
+	Use:   "geography",
+	Short: "Where listeners are, by country, region and city",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("> GEOGRAPHY")
+		startDate, endDate := getDateRange()
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+		if opts.GeoIP == nil {
+			fmt.Println("Error: no GeoIP database, set GEOIP_PATH to a .mmdb file")
+			return
+		}
+
+		data, err := loadLogData(sources, opts)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+		filteredData := caddy.FilterLogData(data, startDate, endDate, opts.Filter)
+
+		err = caddy.OutputJSON(caddy.Geography(filteredData), outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
+	},
+}
+
+var pagesCmd = &cobra.Command{
+	Use:   "pages",
+	Short: "Views and visitors of the web pages, apart from the audio streams",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("> PAGES")
+		startDate, endDate := getDateRange()
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+
+		data, err := loadLogData(sources, opts)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+		filteredData := caddy.FilterLogData(data, startDate, endDate, opts.Filter)
+
+		err = caddy.OutputJSON(caddy.Pages(filteredData), outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
+	},
+}
+
+var subscribersCmd = &cobra.Command{
+	Use:   "subscribers",
+	Short: "Daily estimated feed subscribers per app, from the RSS feed polls",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("> SUBSCRIBERS")
+		startDate, endDate := getDateRange()
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+		// Unchanged feeds are answered with an empty 304: keep them
+		opts.AllResponses = true
+
+		data, err := loadLogData(sources, opts)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+		filteredData := caddy.FilterLogData(data, startDate, endDate, opts.Filter)
+
+		err = caddy.OutputJSON(caddy.Subscribers(filteredData), outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
+	},
+}
+
+var sourcesCmd = &cobra.Command{
+	Use:   "sources",
+	Short: "Where web listeners came from: site, social, newsletter, search",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("> SOURCES")
+		startDate, endDate := getDateRange()
+		sources, err := logSources()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		opts, err := caddyOptions()
+		if err != nil {
+			fmt.Printf("Error in log configuration: %v\n", err)
+			return
+		}
+		defer reportBots(opts)
+		defer reportShows(opts)
+
+		data, err := loadLogData(sources, opts)
+		if err != nil {
+			fmt.Printf("Error loading log data: %v\n", err)
+			return
+		}
+		filteredData := caddy.FilterLogData(data, startDate, endDate, opts.Filter)
+
+		siteDomains := strings.Split(viper.GetString("SITE_DOMAINS"), ",")
+		err = caddy.OutputJSON(caddy.TrafficSources(filteredData, siteDomains, startDate, endDate), outputJson)
+		if err != nil {
+			fmt.Printf("Error saving result: %v\n", err)
+		}
 	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().IntVar(&lastDays, "last", -1, "Number of last days to include (default: all data)")
-	rootCmd.PersistentFlags().StringVar(&filter, "filter", "", "Filter episode names, number or season")
+	rootCmd.PersistentFlags().StringVar(&filter, "filter", "", `Filter query, e.g. 'season:2 episode:>=10 app:overcast country:IT title~"interview"'`)
 	rootCmd.PersistentFlags().StringVar(&outputJson, "json", "", "Output json filepath")
+	rootCmd.PersistentFlags().BoolVar(&iab, "iab", false, "Also count IAB-style downloads (24h windows, one minute of audio, no bots)")
+	rootCmd.PersistentFlags().StringVar(&breakdown, "by", "", "Break counts down by country, region, city, app, device, os or host")
+	rootCmd.PersistentFlags().BoolVar(&includeBots, "include-bots", false, "Count requests matching the bot rules instead of dropping them")
+	rootCmd.PersistentFlags().BoolVar(&noCache, "no-cache", false, "Re-parse the whole log instead of resuming from the cached checkpoint")
+
+	streamsCmd.Flags().BoolVar(&follow, "follow", false, "Keep reading the log as it grows and print updated counts")
+	streamsCmd.Flags().DurationVar(&followInterval, "interval", 10*time.Second, "How often --follow prints updated counts")
+	for _, cmd := range []*cobra.Command{streamsCmd, listenersCmd, summaryCmd} {
+		cmd.Flags().StringVar(&bucket, "bucket", "day", "Roll counts up by hour, day, week (ISO), month or year, with listeners distinct within each")
+	}
 
 	rootCmd.AddCommand(streamsCmd)
+	collectCmd.Flags().DurationVar(&followInterval, "interval", 10*time.Second, "How often collected counts are saved")
+	rootCmd.AddCommand(collectCmd)
+	listCmd.Flags().BoolVar(&listSpotify, "spotify", false, "List the episodes as seen by Spotify instead of the server logs")
 	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(completenessCmd)
+	rootCmd.AddCommand(geographyCmd)
+	rootCmd.AddCommand(sourcesCmd)
+	rootCmd.AddCommand(pagesCmd)
+	rootCmd.AddCommand(subscribersCmd)
+	rootCmd.AddCommand(healthCmd)
+	uaCmd.AddCommand(uaExplainCmd)
+	rootCmd.AddCommand(uaCmd)
 	rootCmd.AddCommand(summaryCmd)
 	rootCmd.AddCommand(listenersCmd)
 	rootCmd.AddCommand(testCmd)
@@ -223,6 +838,15 @@ func init() {
 
 func main() {
 	loadConfig()
+	// Days, weeks and months start at midnight in TIMEZONE, the system
+	// time zone when unset
+	if name := viper.GetString("TIMEZONE"); name != "" {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			log.Fatalf("Error in TIMEZONE: %v", err)
+		}
+		time.Local = location
+	}
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -237,6 +861,10 @@ var listenersCmd = &cobra.Command{
         //=======================================
 		fmt.Println("> LISTENERS")
 		startDate, endDate := getDateRange()
+		if bucket != "day" {
+			bucketListeners(startDate, endDate)
+			return
+		}
 		endpoint := "listeners"
 		listenrs, _ := spotify.Analytics(startDate, endDate, endpoint)
 		// if err != nil {
@@ -253,6 +881,34 @@ var listenersCmd = &cobra.Command{
     },
 }
 
+// bucketListeners prints the distinct listeners of every --bucket from the
+// server logs. Spotify only reports listeners per day, and daily listeners
+// cannot be added up into weekly or monthly ones.
+func bucketListeners(startDate, endDate string) {
+	fmt.Fprintf(os.Stderr, "listeners: Spotify reports daily listeners only, counting the server logs by %s\n", bucket)
+	sources, err := logSources()
+	if err != nil {
+		fmt.Printf("Error in log configuration: %v\n", err)
+		return
+	}
+	opts, err := caddyOptions()
+	if err != nil {
+		fmt.Printf("Error in log configuration: %v\n", err)
+		return
+	}
+	defer reportBots(opts)
+	defer reportShows(opts)
+
+	agg, err := loadAggregate(sources, opts, startDate, endDate)
+	if err != nil {
+		fmt.Printf("Error loading log data: %v\n", err)
+		return
+	}
+	for _, ts := range rollup(agg, startDate, endDate).TimeSeries {
+		fmt.Printf("Date: %s, Count: %d, Spotify: %d\n", ts.Date, ts.All.Listeners, ts.Spotify.Listeners)
+	}
+}
+
 var testCmd= &cobra.Command{
     Use:   "test",
     Short: "Analytics test",
@@ -270,17 +926,33 @@ var testCmd= &cobra.Command{
         }
 
         // CADDY server data
-        source := "web"
-        cddy, err := caddy.TimeAnalytics(startDate, endDate, source)
+        sources, err := logSources()
+        if err != nil {
+            fmt.Println("Error (caddy):", err)
+            return
+        }
+        opts, err := caddyOptions()
+        if err != nil {
+            fmt.Println("Error (caddy):", err)
+            return
+        }
+        cddy, err := caddy.TimeAnalytics(startDate, endDate, sources, opts)
         if err != nil {
             fmt.Println("Error (caddy):", err)
             return
         }
 
-        fmt.Println(cddy)
         // Initialize the original TimeAnalytics struct
         var original data.TimeAnalytics
         original.Name = sptfy
+        // Server side series keep their name unless the API already uses
+        // it: Spotify's own numbers stay under "spotify"
+        for name, series := range cddy {
+            if _, exists := original.Name[name]; exists {
+                name = "caddy/" + name
+            }
+            original.Name[name] = series
+        }
 
         // Print the final result
         // fmt.Println(original)
@@ -288,7 +960,8 @@ var testCmd= &cobra.Command{
         //=======================================
         jsonData, err := json.MarshalIndent(original, "", "  ")
         if err != nil {
-            fmt.Errorf("failed to marshal dataMap to JSON: %w", err)
+            fmt.Println("failed to marshal dataMap to JSON:", err)
+            return
         }
         fmt.Println(string(jsonData))
 
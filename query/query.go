@@ -0,0 +1,327 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of a field, deciding which operators apply to it.
+type Kind int
+
+const (
+	Text   Kind = iota // Compared case-insensitively
+	Number             // Compared numerically
+	Date               // YYYY-MM-DD, compared in calendar order
+)
+
+// Fields are the names a query can test, across every source. A record
+// that lacks a field fails the terms about it.
+var Fields = map[string]Kind{
+	"season":    Number,
+	"episode":   Number,
+	"title":     Text,
+	"guid":      Text,
+	"published": Date,
+	"uri":       Text,
+	"host":      Text,
+	"show":      Text,
+	"referer":   Text,
+	"kind":      Text,
+	"method":    Text,
+	"status":    Number,
+	"app":       Text,
+	"device":    Text,
+	"os":        Text,
+	"category":  Text,
+	"country":   Text,
+	"region":    Text,
+	"city":      Text,
+	"ua":        Text,
+}
+
+// Record is anything a query can be applied to.
+type Record interface {
+	// Field returns the value of a field, ok false when the record does
+	// not know it.
+	Field(name string) (value string, ok bool)
+	// Keyword reports whether a bare word of the query designates the
+	// record, the way the historical --filter keywords did.
+	Keyword(word string) bool
+}
+
+// term is one condition: field op value, or a bare keyword when field is
+// empty.
+type term struct {
+	negate bool
+	field  string
+	op     string
+	value  string
+	number float64
+}
+
+// Query is a parsed filter: every term must hold for a record to match.
+type Query struct {
+	terms []term
+	text  string
+}
+
+// termSyntax splits field:value, field:>=value, field~value and friends.
+var termSyntax = regexp.MustCompile(`^([A-Za-z]+)(:>=|:<=|:>|:<|:|~)(.*)$`)
+
+var dateSyntax = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// Parse reads a query such as
+//
+//	season:2 episode:>=10 app:overcast country:IT title~"interview" -host:staging
+//
+// Terms are separated by spaces and must all hold. The operators are ":"
+// (equals), ":>", ":>=", ":<", ":<=" (numbers and dates) and "~" (contains);
+// a leading "-" negates a term. Values with spaces go in double quotes.
+// Words without an operator are keywords (see Record.Keyword).
+func Parse(text string) (*Query, error) {
+	words, err := split(text)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Query{}
+	var canonical []string
+	for _, word := range words {
+		t, err := parseTerm(word)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter term %s: %w", word, err)
+		}
+		q.terms = append(q.terms, t)
+		canonical = append(canonical, t.String())
+	}
+	q.text = strings.Join(canonical, " ")
+	return q, nil
+}
+
+// split cuts text at spaces outside double quotes.
+func split(text string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	quoted, escaped := false, false
+	for _, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+			continue
+		}
+		word.WriteRune(r)
+	}
+	if quoted {
+		return nil, errors.New("invalid filter: unterminated quote")
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func parseTerm(word string) (term, error) {
+	var t term
+	if strings.HasPrefix(word, "-") && len(word) > 1 {
+		t.negate = true
+		word = word[1:]
+	}
+
+	m := termSyntax.FindStringSubmatch(word)
+	if m == nil {
+		value, err := unquote(word)
+		if err != nil {
+			return t, err
+		}
+		t.value = value
+		return t, nil
+	}
+
+	t.field, t.op = strings.ToLower(m[1]), m[2]
+	kind, known := Fields[t.field]
+	if !known {
+		return t, fmt.Errorf("unknown field %q (supported: %s)", m[1], strings.Join(FieldNames(), ", "))
+	}
+	value, err := unquote(m[3])
+	if err != nil {
+		return t, err
+	}
+	if value == "" {
+		return t, fmt.Errorf("missing value after %s%s", m[1], t.op)
+	}
+	t.value = value
+
+	ordered := t.op != ":" && t.op != "~"
+	switch kind {
+	case Number:
+		if t.op == "~" {
+			return t, fmt.Errorf("%s is a number: use %s:value or a comparison", t.field, t.field)
+		}
+		t.number, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return t, fmt.Errorf("%s needs a number, got %q", t.field, value)
+		}
+	case Date:
+		if t.op != "~" && !dateSyntax.MatchString(value) {
+			return t, fmt.Errorf("%s needs a date as YYYY, YYYY-MM or YYYY-MM-DD, got %q", t.field, value)
+		}
+	case Text:
+		if ordered {
+			return t, fmt.Errorf("%s is text: comparisons only apply to numbers and dates", t.field)
+		}
+	}
+	return t, nil
+}
+
+// unquote removes the double quotes around a value, if any.
+func unquote(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		if strings.Contains(value, `"`) {
+			return "", errors.New("quotes must surround the whole value")
+		}
+		return value, nil
+	}
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted value %s", value)
+	}
+	return unquoted, nil
+}
+
+// FieldNames lists Fields in alphabetical order.
+func FieldNames() []string {
+	names := make([]string, 0, len(Fields))
+	for name := range Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t term) String() string {
+	value := t.value
+	if strings.ContainsAny(value, " \t\"\\") {
+		value = strconv.Quote(value)
+	}
+	prefix := ""
+	if t.negate {
+		prefix = "-"
+	}
+	return prefix + t.field + t.op + value
+}
+
+// String is the canonical form of the query, identifying it in cache names.
+func (q *Query) String() string {
+	if q == nil {
+		return ""
+	}
+	return q.text
+}
+
+// Empty reports whether the query has no terms, matching everything.
+func (q *Query) Empty() bool {
+	return q == nil || len(q.terms) == 0
+}
+
+// Select returns the query restricted to the terms about the given fields
+// and the keywords, for sources that only know some fields: a Spotify
+// episode has no app, so app:overcast cannot filter it out.
+func (q *Query) Select(fields ...string) *Query {
+	if q == nil {
+		return nil
+	}
+	keep := make(map[string]bool, len(fields)+1)
+	keep[""] = true
+	for _, field := range fields {
+		keep[field] = true
+	}
+
+	selected := &Query{}
+	var canonical []string
+	for _, t := range q.terms {
+		if keep[t.field] {
+			selected.terms = append(selected.terms, t)
+			canonical = append(canonical, t.String())
+		}
+	}
+	selected.text = strings.Join(canonical, " ")
+	return selected
+}
+
+// Match reports whether every term holds for r. A nil query matches
+// everything.
+func (q *Query) Match(r Record) bool {
+	if q == nil {
+		return true
+	}
+	for _, t := range q.terms {
+		if t.holds(r) == t.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (t term) holds(r Record) bool {
+	if t.field == "" {
+		return r.Keyword(t.value)
+	}
+	value, ok := r.Field(t.field)
+	if !ok {
+		return false
+	}
+
+	switch Fields[t.field] {
+	case Number:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		return compare(t.op, n-t.number)
+	case Date:
+		if t.op == "~" {
+			return strings.Contains(value, t.value)
+		}
+		if t.op == ":" {
+			return strings.HasPrefix(value, t.value)
+		}
+		// A partial date compares with the same part of the value
+		if len(value) > len(t.value) {
+			value = value[:len(t.value)]
+		}
+		return compare(t.op, float64(strings.Compare(value, t.value)))
+	default:
+		if t.op == "~" {
+			return strings.Contains(strings.ToLower(value), strings.ToLower(t.value))
+		}
+		return strings.EqualFold(value, t.value)
+	}
+}
+
+// compare applies an operator to the sign of value minus wanted.
+func compare(op string, diff float64) bool {
+	switch op {
+	case ":>":
+		return diff > 0
+	case ":>=":
+		return diff >= 0
+	case ":<":
+		return diff < 0
+	case ":<=":
+		return diff <= 0
+	}
+	return diff == 0
+}
@@ -0,0 +1,149 @@
+package query
+
+import (
+	"strings"
+	"testing"
+)
+
+// record is a Record with fixed fields, designated by the keywords in
+// words.
+type record struct {
+	fields map[string]string
+	words  []string
+}
+
+func (r record) Field(name string) (string, bool) {
+	value, ok := r.fields[name]
+	return value, ok
+}
+
+func (r record) Keyword(word string) bool {
+	for _, w := range r.words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+var episode = record{
+	fields: map[string]string{
+		"season":    "2",
+		"episode":   "12",
+		"title":     "An Interview with \"Ada\"",
+		"published": "2024-06-15",
+		"app":       "Overcast",
+		"host":      "pod.example.com",
+	},
+	words: []string{"s2e12"},
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{"title:>x", "comparisons only apply to numbers and dates"},
+		{"season~2", "season is a number"},
+		{`title:"interview`, "unterminated quote"},
+		{"colour:red", `unknown field "colour"`},
+		{"season:two", `season needs a number, got "two"`},
+		{"published:>June", "published needs a date"},
+		{"published:2024-6", "published needs a date"},
+		{"app:", "missing value after app:"},
+		{`title:Ada"s"`, "quotes must surround the whole value"},
+		{`title:"a\qb"`, "invalid quoted value"},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.text)
+		if err == nil {
+			t.Errorf("Parse(%s) = %q, want an error", test.text, q)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Parse(%s): %v, want %q", test.text, err, test.err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		text  string
+		match bool
+	}{
+		{"", true},
+		{"season:2", true},
+		{"season:3", false},
+		{"episode:>=12 episode:<13", true},
+		{"episode:>12", false},
+		{"app:overcast", true},
+		{"-app:overcast", false},
+		{"-app:spotify", true},
+		{"title~interview", true},
+		{"-title~interview", false},
+		{`title:"an interview with \"ada\""`, true},
+		{`title~"with \"Ada"`, true},
+		{"title~\"Ada\\\"\"", true},
+		// A record without the field fails the term, and holds its negation
+		{"country:IT", false},
+		{"-country:IT", true},
+		{"s2e12", true},
+		{"-s2e12", false},
+		{"s1", false},
+		// Partial dates compare with the same part of the date
+		{"published:2024", true},
+		{"published:2024-06", true},
+		{"published:2024-07", false},
+		{"published:>=2024-06", true},
+		{"published:>2024-06", false},
+		{"published:<2025", true},
+		{"published:<=2024-06-14", false},
+		{"published~-06-", true},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.text)
+		if err != nil {
+			t.Errorf("Parse(%s): %v", test.text, err)
+			continue
+		}
+		if got := q.Match(episode); got != test.match {
+			t.Errorf("%s matches %v, want %v", test.text, got, test.match)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	q, err := Parse(`  Season:2   title~"big  news" -APP:overcast word`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `season:2 title~"big  news" -app:overcast word`
+	if q.String() != want {
+		t.Errorf("canonical form %q, want %q", q.String(), want)
+	}
+	if again, err := Parse(q.String()); err != nil || again.String() != want {
+		t.Errorf("canonical form parses to %q (%v), want itself", again, err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	q, err := Parse("season:3 app:spotify s2e12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := q.Select("app")
+	if got := selected.String(); got != "app:spotify s2e12" {
+		t.Errorf("selected %q, want the app term and the keyword", got)
+	}
+	if selected.Match(episode) {
+		t.Error("selected query matches an Overcast record, want app:spotify to hold")
+	}
+	if !q.Select("title").Match(episode) {
+		t.Error("query without its season and app terms does not match, want the keyword alone to")
+	}
+
+	var none *Query
+	if !none.Match(episode) || none.Select("app") != nil || !none.Empty() {
+		t.Error("nil query does not match everything")
+	}
+}
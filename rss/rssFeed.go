@@ -0,0 +1,336 @@
+package rss
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fetchTimeout bounds how long downloading a feed may take.
+const fetchTimeout = 30 * time.Second
+
+// Episode is one item of the feed.
+type Episode struct {
+	GUID      string        `json:"guid"`
+	Title     string        `json:"title"`
+	Season    int           `json:"season,omitempty"`
+	Number    int           `json:"episode,omitempty"`
+	Published time.Time     `json:"published"`
+	Duration  time.Duration `json:"duration"`
+	URL       string        `json:"url"`            // Enclosure URL
+	Length    int64         `json:"length"`         // Enclosure size in bytes
+	Link      string        `json:"link,omitempty"` // Episode web page
+
+	path string // Enclosure path, without tracking prefixes
+}
+
+// Feed is a parsed podcast feed.
+type Feed struct {
+	Title    string
+	Episodes []*Episode
+
+	byPath map[string]*Episode
+	byName map[string][]*Episode
+	byPage map[string]*Episode
+}
+
+// item mirrors the parts of an RSS <item> we read, including the Apple
+// Podcasts tags (itunes:season...).
+type item struct {
+	GUID      string   `xml:"guid"`
+	Title     string   `xml:"title"`
+	PubDate   string   `xml:"pubDate"`
+	Links     []string `xml:"link"` // Also matches an empty atom:link
+	Enclosure struct {
+		URL    string `xml:"url,attr"`
+		Length string `xml:"length,attr"`
+	} `xml:"enclosure"`
+	Season   string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd season"`
+	Episode  string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
+	Duration string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+}
+
+type document struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Items []item `xml:"item"`
+	} `xml:"channel"`
+}
+
+// Load reads a feed from an http(s) URL or a local file.
+func Load(source string) (*Feed, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := http.Client{Timeout: fetchTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch feed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch feed: %s", resp.Status)
+		}
+		return Parse(resp.Body)
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open feed: %w", err)
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// Parse decodes an RSS 2.0 podcast feed. Items without an enclosure are
+// left out.
+func Parse(r io.Reader) (*Feed, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feed: %w", err)
+	}
+
+	var doc document
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse feed: %w", err)
+	}
+
+	feed := &Feed{
+		Title:  strings.TrimSpace(doc.Channel.Title),
+		byPath: make(map[string]*Episode),
+		byName: make(map[string][]*Episode),
+		byPage: make(map[string]*Episode),
+	}
+	for _, it := range doc.Channel.Items {
+		enclosure := strings.TrimSpace(it.Enclosure.URL)
+		if enclosure == "" {
+			continue
+		}
+
+		episode := &Episode{
+			GUID:      strings.TrimSpace(it.GUID),
+			Title:     strings.TrimSpace(it.Title),
+			Published: parseDate(it.PubDate),
+			Duration:  parseDuration(it.Duration),
+			URL:       enclosure,
+			path:      enclosurePath(enclosure),
+		}
+		episode.Season, _ = strconv.Atoi(strings.TrimSpace(it.Season))
+		episode.Number, _ = strconv.Atoi(strings.TrimSpace(it.Episode))
+		episode.Length, _ = strconv.ParseInt(strings.TrimSpace(it.Enclosure.Length), 10, 64)
+		if episode.GUID == "" {
+			episode.GUID = enclosure
+		}
+		for _, link := range it.Links {
+			if link = strings.TrimSpace(link); link != "" {
+				episode.Link = link
+				break
+			}
+		}
+
+		feed.Episodes = append(feed.Episodes, episode)
+		if _, dup := feed.byPath[episode.path]; !dup {
+			feed.byPath[episode.path] = episode
+		}
+		name := path.Base(episode.path)
+		feed.byName[name] = append(feed.byName[name], episode)
+
+		// The home page is no episode's page, even if items link to it
+		if page := pagePath(episode.Link); page != "/" {
+			if _, dup := feed.byPage[page]; !dup {
+				feed.byPage[page] = episode
+			}
+		}
+	}
+	return feed, nil
+}
+
+// Digest identifies which episode every enclosure path belongs to, so
+// that counts keyed by episode are not resumed with another mapping. New
+// titles, dates and sizes leave it unchanged.
+func (f *Feed) Digest() string {
+	paths := make([]string, 0, len(f.byPath))
+	for path := range f.byPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(h, "%s\x00%s\x00", path, f.byPath[path].GUID)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// pagePath is the path of a web page URL, without the query string or a
+// trailing slash.
+func pagePath(link string) string {
+	if i := strings.Index(link, "://"); i >= 0 {
+		link = link[i+3:]
+		if j := strings.IndexByte(link, '/'); j >= 0 {
+			link = link[j:]
+		} else {
+			link = "/"
+		}
+	}
+	link, _, _ = strings.Cut(link, "?")
+	link, _, _ = strings.Cut(link, "#")
+	if unescaped, err := url.PathUnescape(link); err == nil {
+		link = unescaped
+	}
+	if trimmed := strings.TrimRight(link, "/"); trimmed != "" {
+		return trimmed
+	}
+	return "/"
+}
+
+// Match returns the episode whose enclosure a request URI points to. The
+// query string is ignored, and enclosures behind tracking prefixes
+// (https://dts.podtrac.com/redirect.mp3/example.com/e1.mp3) match the
+// request for the file itself (/e1.mp3).
+func (f *Feed) Match(uri string) (*Episode, bool) {
+	requestPath, _, _ := strings.Cut(uri, "?")
+	if episode, ok := f.byPath[requestPath]; ok {
+		return episode, true
+	}
+
+	var best *Episode
+	for _, episode := range f.byName[path.Base(requestPath)] {
+		if !strings.HasSuffix(episode.path, requestPath) && !strings.HasSuffix(requestPath, episode.path) {
+			continue
+		}
+		if best == nil || len(episode.path) < len(best.path) {
+			best = episode
+		}
+	}
+	return best, best != nil
+}
+
+// MatchPage returns the episode whose web page (the item <link>) a
+// request URI points to.
+func (f *Feed) MatchPage(uri string) (*Episode, bool) {
+	episode, ok := f.byPage[pagePath(uri)]
+	return episode, ok
+}
+
+// episodeKeyword matches "s2", "e5", "ep5" and "s2e5" style filters.
+var episodeKeyword = regexp.MustCompile(`(?i)^(?:s(\d+))?(?:e(?:p)?(\d+))?$`)
+
+// Matches reports whether a filter keyword designates the episode: its
+// season and/or number ("s2", "e5", "s2e5"), its GUID, or a case-insensitive
+// part of its title or enclosure URL.
+func (e *Episode) Matches(keyword string) bool {
+	if keyword == e.GUID {
+		return true
+	}
+	if m := episodeKeyword.FindStringSubmatch(keyword); m != nil && keyword != "" {
+		if numberMatches(m[1], e.Season) && numberMatches(m[2], e.Number) {
+			return true
+		}
+	}
+	keyword = strings.ToLower(keyword)
+	return strings.Contains(strings.ToLower(e.Title), keyword) ||
+		strings.Contains(strings.ToLower(e.URL), keyword)
+}
+
+// Keyword is Matches, for filter queries.
+func (e *Episode) Keyword(word string) bool {
+	return e.Matches(word)
+}
+
+// Field returns the metadata a filter query can test.
+func (e *Episode) Field(name string) (string, bool) {
+	switch name {
+	case "season":
+		return strconv.Itoa(e.Season), e.Season != 0
+	case "episode":
+		return strconv.Itoa(e.Number), e.Number != 0
+	case "title":
+		return e.Title, true
+	case "guid":
+		return e.GUID, true
+	case "published":
+		return e.Published.Format("2006-01-02"), !e.Published.IsZero()
+	}
+	return "", false
+}
+
+// numberMatches compares a season or episode number from a keyword with
+// the one of the feed, where 0 means unknown.
+func numberMatches(keyword string, number int) bool {
+	if keyword == "" {
+		return true
+	}
+	n, _ := strconv.Atoi(keyword)
+	return number != 0 && n == number
+}
+
+// enclosurePath extracts the path of the audio file from an enclosure URL,
+// skipping the tracking redirects (op3.dev/e/https://..., podtrac, ...)
+// that wrap the real URL.
+func enclosurePath(enclosure string) string {
+	rest := enclosure
+	if i := strings.LastIndex(rest, "://"); i >= 0 {
+		rest = rest[i+3:]
+	}
+	rest, _, _ = strings.Cut(rest, "?")
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest = rest[i:]
+	} else {
+		rest = "/"
+	}
+	if unescaped, err := url.PathUnescape(rest); err == nil {
+		rest = unescaped
+	}
+	return rest
+}
+
+// pubDateLayouts are the RFC 822 variants seen in the wild.
+var pubDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC3339,
+}
+
+func parseDate(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range pubDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseDuration reads itunes:duration, given either in seconds or as
+// [HH:]MM:SS.
+func parseDuration(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	seconds := 0.0
+	for _, part := range strings.Split(value, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,113 @@
+package rss
+
+import (
+	"testing"
+	"time"
+)
+
+func loadFixture(t *testing.T) *Feed {
+	t.Helper()
+	feed, err := Load("testdata/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func TestParse(t *testing.T) {
+	feed := loadFixture(t)
+	if feed.Title != "Example Show" {
+		t.Errorf("title %q, want Example Show", feed.Title)
+	}
+	if len(feed.Episodes) != 3 {
+		t.Fatalf("got %d episodes, want the 3 with an enclosure", len(feed.Episodes))
+	}
+
+	tests := []struct {
+		guid      string
+		published time.Time
+		duration  time.Duration
+		length    int64
+	}{
+		{"ep-1", time.Date(2024, 6, 3, 4, 0, 0, 0, time.UTC), time.Hour + 2*time.Minute + 3*time.Second, 1000000},
+		{"ep-2", time.Date(2024, 6, 10, 6, 0, 0, 0, time.UTC), 1830 * time.Second, 2000000},
+		// Without a GUID the enclosure names the episode
+		{"https://cdn.example.com/bonus/e2.mp3", time.Time{}, 12*time.Minute + 30*time.Second, 300},
+	}
+	for i, test := range tests {
+		episode := feed.Episodes[i]
+		if episode.GUID != test.guid {
+			t.Errorf("episode %d: GUID %q, want %q", i, episode.GUID, test.guid)
+		}
+		if !episode.Published.Equal(test.published) {
+			t.Errorf("%s: published %v, want %v", test.guid, episode.Published, test.published)
+		}
+		if episode.Duration != test.duration {
+			t.Errorf("%s: duration %v, want %v", test.guid, episode.Duration, test.duration)
+		}
+		if episode.Length != test.length {
+			t.Errorf("%s: length %d, want %d", test.guid, episode.Length, test.length)
+		}
+	}
+	if pilot := feed.Episodes[0]; pilot.Season != 1 || pilot.Number != 1 {
+		t.Errorf("pilot %+v, want season 1, episode 1", pilot)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	feed := loadFixture(t)
+	tests := []struct {
+		uri  string
+		guid string // Empty for no match
+	}{
+		// Tracking prefixes are stripped from the enclosure
+		{"/audio/e1.mp3", "ep-1"},
+		{"/audio/e1.mp3?_=123", "ep-1"},
+		// Escapes in the enclosure URL are undone
+		{"/audio/season 1/e2.mp3", "ep-2"},
+		// Same file name: the path suffix tells the episodes apart
+		{"/bonus/e2.mp3", "https://cdn.example.com/bonus/e2.mp3"},
+		{"/mirror/bonus/e2.mp3", "https://cdn.example.com/bonus/e2.mp3"},
+		{"/e1.mp3", "ep-1"},
+		{"/other/e2.mp3", ""},
+		{"/audio/e3.mp3", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if episode, ok := feed.Match(test.uri); ok {
+			got = episode.GUID
+		}
+		if got != test.guid {
+			t.Errorf("Match(%q) = %q, want %q", test.uri, got, test.guid)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	feed := loadFixture(t)
+	digest := feed.Digest()
+
+	feed.Episodes[0].Title = "Renamed"
+	if feed.Digest() != digest {
+		t.Error("digest changed with a title")
+	}
+	feed.byPath["/audio/e1.mp3"] = feed.Episodes[1]
+	if feed.Digest() == digest {
+		t.Error("digest unchanged with an enclosure moved to another episode")
+	}
+}
+
+func TestMatchPage(t *testing.T) {
+	feed := loadFixture(t)
+	if link := feed.Episodes[0].Link; link != "https://pod.example.com/episodes/pilot/" {
+		t.Errorf("pilot links to %q, want its page", link)
+	}
+	for _, uri := range []string{"/episodes/pilot", "/episodes/pilot/?ref=home"} {
+		if episode, ok := feed.MatchPage(uri); !ok || episode.GUID != "ep-1" {
+			t.Errorf("MatchPage(%q) = %v, want ep-1", uri, episode)
+		}
+	}
+	if episode, ok := feed.MatchPage("/"); ok {
+		t.Errorf("MatchPage(/) = %q, want no episode", episode.GUID)
+	}
+}
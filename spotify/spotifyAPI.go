@@ -46,7 +46,11 @@ func Analytics(startDate, endDate, endpoint string) (interface{}, error) {
 
 	switch endpoint {
 	case "listeners":
-		return processListenersData(body)
+		counts, err := processListenersData(body)
+		if err != nil {
+			return nil, err
+		}
+		return fillListeners(counts, startDate, endDate), nil
 	case "detailedStreams":
 		return processDetailedStreamsData(body)
 	default:
@@ -0,0 +1,116 @@
+package spotify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ruvido/goSpotifyPodcastAnalytics/query"
+	"github.com/ruvido/goSpotifyPodcastAnalytics/rss"
+	"github.com/spf13/viper"
+)
+
+// episodesPageSize is how many episodes are asked for at a time.
+const episodesPageSize = 50
+
+// Episode is one row of the show's episode list.
+type Episode struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ReleaseDate string `json:"releaseDate"`
+	Starts      int    `json:"starts"`
+	Streams     int    `json:"streams"`
+	Listeners   int    `json:"listeners"`
+
+	// From the RSS feed, see linkFeed
+	Season int `json:"season,omitempty"`
+	Number int `json:"episode,omitempty"`
+}
+
+// EpisodeFields are the filter query fields a Spotify episode knows;
+// terms about other fields (app, country...) are left out with
+// query.Select.
+var EpisodeFields = []string{"season", "episode", "title", "guid", "published"}
+
+// Field returns what a filter query can test about an episode.
+func (e Episode) Field(name string) (string, bool) {
+	switch name {
+	case "season":
+		return strconv.Itoa(e.Season), e.Season != 0
+	case "episode":
+		return strconv.Itoa(e.Number), e.Number != 0
+	case "title":
+		return e.Name, true
+	case "guid":
+		return e.ID, true
+	case "published":
+		if len(e.ReleaseDate) < 10 {
+			return "", false
+		}
+		return e.ReleaseDate[:10], true
+	}
+	return "", false
+}
+
+// Keyword reports whether a bare filter word is part of the title.
+func (e Episode) Keyword(word string) bool {
+	return strings.Contains(strings.ToLower(e.Name), strings.ToLower(word))
+}
+
+// Episodes lists the show's episodes with their numbers between startDate
+// and endDate, keeping those matching filter. feed, when not nil, supplies
+// season and episode numbers.
+func Episodes(startDate, endDate string, feed *rss.Feed, filter *query.Query) ([]Episode, error) {
+	showID := viper.GetString("SHOW_ID")
+	filter = filter.Select(EpisodeFields...)
+
+	var episodes []Episode
+	for page := 1; ; page++ {
+		params := url.Values{}
+		params.Set("start", startDate)
+		params.Set("end", endDate)
+		params.Set("page", strconv.Itoa(page))
+		params.Set("size", strconv.Itoa(episodesPageSize))
+		params.Set("sortBy", "releaseDate")
+		params.Set("sortOrder", "descending")
+
+		spotifyURL := spotifyGenericURL + "/shows/" + showID + "/episodes?" + params.Encode()
+		body := spotifyGETRequest(spotifyURL)
+
+		var response struct {
+			Episodes []Episode `json:"episodes"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal episodes data: %w", err)
+		}
+		if feed != nil {
+			linkFeed(response.Episodes, feed)
+		}
+		for _, episode := range response.Episodes {
+			if filter.Match(episode) {
+				episodes = append(episodes, episode)
+			}
+		}
+		if len(response.Episodes) < episodesPageSize {
+			break
+		}
+	}
+	return episodes, nil
+}
+
+// linkFeed copies the season and episode numbers of the feed items onto
+// the Spotify episodes with the same title, so that season:2 style
+// filters apply to them.
+func linkFeed(episodes []Episode, feed *rss.Feed) {
+	byTitle := make(map[string]*rss.Episode, len(feed.Episodes))
+	for _, item := range feed.Episodes {
+		byTitle[strings.ToLower(item.Title)] = item
+	}
+	for i := range episodes {
+		if item, ok := byTitle[strings.ToLower(strings.TrimSpace(episodes[i].Name))]; ok {
+			episodes[i].Season, episodes[i].Number = item.Season, item.Number
+		}
+	}
+}
@@ -16,6 +16,22 @@ type ListenersData struct {
 	Count int    `json:"count"`
 }
 
+// fillListeners sorts counts and zero-fills the days from startDate to
+// endDate the API left out, as data.FillGaps does for the time series.
+func fillListeners(counts []ListenersData, startDate, endDate string) []ListenersData {
+	series := make([]data.DailyAnalytics, 0, len(counts))
+	for _, count := range counts {
+		series = append(series, data.DailyAnalytics{Date: count.Date, Listeners: count.Count})
+	}
+
+	series = data.FillGaps(series, startDate, endDate)
+	filled := make([]ListenersData, 0, len(series))
+	for _, day := range series {
+		filled = append(filled, ListenersData{Date: day.Date, Count: day.Listeners})
+	}
+	return filled
+}
+
 // Data structure for detailedStreams endpoint
 type DetailedStreamsData struct {
 	Date    string `json:"date"`
@@ -68,6 +84,8 @@ func TimeAnalytics(startDate, endDate string, endpoints []string) (map[string][]
         })
     }
 
+    // The API skips days without listeners: sort and zero-fill them
+    dataMap["spotify"] = data.FillGaps(dataMap["spotify"], startDate, endDate)
     return dataMap, nil
 }
 